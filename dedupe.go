@@ -0,0 +1,58 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+)
+
+var (
+	dedupe      = flag.Bool("dedupe", false, "Print each distinct selected line only the first time it is found, in whichever file that is")
+	dedupeCount = flag.Bool("dedupe-count", false, "Like -dedupe, but print the distinct lines once the search is over, each followed by how many times it was selected")
+)
+
+// A dedupeEntry is a distinct line selected with the dedupe flag.
+type dedupeEntry struct {
+	first *match // where the line was first selected
+	times int
+}
+
+// seenLines maps each distinct line selected so far to its entry, and
+// seenOrder holds the entries in the order they were first seen.  Like
+// remaining, they are only used by the goroutine doing the search.
+var (
+	seenLines = make(map[string]*dedupeEntry)
+	seenOrder []*dedupeEntry
+)
+
+// firstSeen records the selected line m, and reports whether it should be
+// passed on to be printed.  Without the dedupe flag every line is, with it
+// only the first of each distinct line is, and with dedupe-count none are
+// (sendDeduped sends them once the search is over).
+func firstSeen(m *match) bool {
+	if !*dedupe {
+		return true
+	}
+	if e := seenLines[m.line]; e != nil {
+		e.times++
+		return false
+	}
+	e := &dedupeEntry{m, 1}
+	seenLines[m.line] = e
+	seenOrder = append(seenOrder, e)
+	return !*dedupeCount
+}
+
+// sendDeduped writes the distinct lines found with dedupe-count to c,
+// along with how many times each was selected.
+func sendDeduped(c chan *match) {
+	if !*dedupeCount {
+		return
+	}
+	for _, e := range seenOrder {
+		times := "times"
+		if e.times == 1 {
+			times = "time"
+		}
+		c <- &match{e.first.file, fmt.Sprintf("%s (%d %s)", e.first.line, e.times, times)}
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestFirstSeen(t *testing.T) {
+	setFlags(t, "dedupe", "true")
+	lines := []*match{{"a", "x"}, {"a", "y"}, {"b", "x"}, {"b", "z"}, {"b", "x"}}
+	var passed []string
+	for _, m := range lines {
+		if firstSeen(m) {
+			passed = append(passed, m.file+":"+m.line)
+		}
+	}
+	if want := []string{"a:x", "a:y", "b:z"}; !reflect.DeepEqual(passed, want) {
+		t.Errorf("-dedupe passed %q, want %q", passed, want)
+	}
+	if seenLines["x"].times != 3 || seenLines["x"].first != lines[0] {
+		t.Errorf("-dedupe recorded x %d times, first in %v", seenLines["x"].times, seenLines["x"].first)
+	}
+}
+
+func TestDedupe(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"a.txt": "foo x\nfoo y\nfoo x\nbar\n",
+		"b.txt": "foo y\nfoo z\n",
+	})
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"-dedupe", "foo", "a.txt", "b.txt"}, "a.txt: foo x\na.txt: foo y\nb.txt: foo z\n"},
+		{[]string{"-dedupe-count", "foo", "a.txt", "b.txt"}, "a.txt: foo x (2 times)\na.txt: foo y (2 times)\nb.txt: foo z (1 time)\n"},
+		{[]string{"-dedupe", "-c", "foo", "a.txt", "b.txt"}, ""},
+	}
+	for _, test := range tests {
+		if stdout, _, _ := runGrep(t, dir, "", test.args...); stdout != test.want {
+			t.Errorf("grep %s printed %q, want %q", strings.Join(test.args, " "), stdout, test.want)
+		}
+	}
+}
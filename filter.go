@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// A globRule is a single include or exclude glob.
+type globRule struct {
+	glob    string
+	exclude bool
+	final   bool // set for -exclude rules, which later rules can't override
+}
+
+// rules holds the rules from the -include, -exclude and -glob flags and
+// the files named by -include-from and -exclude-from, in the order they
+// were given.
+var rules []globRule
+
+// A ruleFlag is a flag.Value that adds to rules each time it is set.
+type ruleFlag func(value string) error
+
+func (f ruleFlag) String() string {
+	return ""
+}
+
+func (f ruleFlag) Set(value string) error {
+	return f(value)
+}
+
+var filenamePattern = flag.String("filename-pattern", "", "Only search files whose base name matches this regular expression (files that don't match are never opened)")
+
+// filenameRegexp is the compiled filename-pattern, or nil if it isn't set.
+var filenameRegexp *regexp.Regexp
+
+var globMatch = flag.String("glob-match", "basename", "What -include, -exclude and -glob globs are matched against: basename, relative (the path below the directory operand) or absolute")
+
+func init() {
+	flag.Var(ruleFlag(func(glob string) error {
+		return addRule(glob, false, false)
+	}), "include", "Only search files whose name matches this `glob` (can be repeated)")
+	flag.Var(ruleFlag(func(glob string) error {
+		return addRule(glob, true, true)
+	}), "exclude", "Skip files whose name matches this `glob`, whatever other rules say (can be repeated)")
+	flag.Var(ruleFlag(func(glob string) error {
+		if strings.HasPrefix(glob, "!") {
+			return addRule(glob[1:], true, false)
+		}
+		return addRule(glob, false, false)
+	}), "glob", "Include files whose name matches this `glob`, or exclude them if it starts with ! (can be repeated, and the last matching -glob wins)")
+	flag.Var(ruleFlag(func(file string) error {
+		return addRulesFrom(file, false, false)
+	}), "include-from", "Read -include globs from this `file`, one per line")
+	flag.Var(ruleFlag(func(file string) error {
+		return addRulesFrom(file, true, true)
+	}), "exclude-from", "Read -exclude globs from this `file`, one per line")
+}
+
+// addRule appends a rule to rules, if its glob is valid.
+func addRule(glob string, exclude, final bool) error {
+	if _, err := filepath.Match(glob, ""); err != nil {
+		return err
+	}
+	rules = append(rules, globRule{glob, exclude, final})
+	return nil
+}
+
+// addRulesFrom appends a rule to rules for each glob in a file.
+func addRulesFrom(file string, exclude, final bool) error {
+	globs, err := readPatternFile(file)
+	if err != nil {
+		return err
+	}
+	for _, glob := range globs {
+		if err := addRule(glob, exclude, final); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkFilters checks the flags that control which files are searched.
+func checkFilters() error {
+	switch *globMatch {
+	case "basename", "relative", "absolute":
+	default:
+		return fmt.Errorf("Invalid value for -glob-match: %s", *globMatch)
+	}
+	if *filenamePattern != "" {
+		re, err := regexp.Compile(*filenamePattern)
+		if err != nil {
+			return fmt.Errorf("Invalid value for -filename-pattern: %s", err.Error())
+		}
+		filenameRegexp = re
+	}
+	return nil
+}
+
+// nameMatches reports whether the base name of a file matches the
+// filename-pattern flag, if it is set.
+func nameMatches(name string) bool {
+	return filenameRegexp == nil || filenameRegexp.MatchString(filepath.Base(name))
+}
+
+// readPatternFile returns the patterns in a file, one per line.  Blank
+// lines, and lines starting with # are ignored.
+func readPatternFile(name string) ([]string, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var patterns []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		patterns = append(patterns, line)
+	}
+	return patterns, scanner.Err()
+}
+
+// included reports whether a file should be searched, according to the
+// rules.  A file matching an -exclude glob is never searched.  Otherwise
+// the last rule the file matches decides, and a file that matches no rule
+// is only searched if there are no include rules.  root is the operand the
+// file was found under (the file itself, if it is an operand).
+func included(name, root string) bool {
+	target := globTarget(name, root)
+	searched := true
+	for _, rule := range rules {
+		if !rule.exclude {
+			searched = false
+			break
+		}
+	}
+	for _, rule := range rules {
+		if ok, _ := filepath.Match(rule.glob, target); !ok {
+			continue
+		}
+		if rule.final {
+			return false
+		}
+		searched = !rule.exclude
+	}
+	return searched
+}
+
+// globTarget returns the string that the rules' globs are matched against
+// for a file, according to the glob-match flag.
+func globTarget(name, root string) string {
+	switch *globMatch {
+	case "relative":
+		// operands are matched as they were given
+		if rel, err := filepath.Rel(root, name); err == nil && rel != "." {
+			return rel
+		}
+		return name
+	case "absolute":
+		if abs, err := filepath.Abs(name); err == nil {
+			return abs
+		}
+		return name
+	}
+	return filepath.Base(name)
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestIncludeExcludeFrom(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"tree/a.go":   "",
+		"tree/b.go":   "",
+		"tree/c.md":   "",
+		"tree/d.txt":  "",
+		"include.txt": "# sources\n*.go\n\n  *.md  \n",
+		"exclude.txt": "b.*\n",
+	})
+	tree := filepath.Join(dir, "tree")
+	tests := []struct {
+		flags []string
+		want  []string
+	}{
+		{[]string{"include-from", "include.txt"}, []string{"a.go", "b.go", "c.md"}},
+		{[]string{"exclude-from", "exclude.txt"}, []string{"a.go", "c.md", "d.txt"}},
+		{[]string{"include-from", "include.txt", "exclude-from", "exclude.txt"}, []string{"a.go", "c.md"}},
+	}
+	for _, test := range tests {
+		flags := []string{"r", "true"}
+		for i := 0; i < len(test.flags); i += 2 {
+			flags = append(flags, test.flags[i], filepath.Join(dir, test.flags[i+1]))
+		}
+		setFlags(t, flags...)
+		var want []string
+		for _, name := range test.want {
+			want = append(want, filepath.Join(tree, name))
+		}
+		if got := inputFiles([]string{tree}); !reflect.DeepEqual(got, want) {
+			t.Errorf("%q found %q, want %q", test.flags, got, want)
+		}
+	}
+
+	setFlags(t)
+	if err := addRulesFrom(filepath.Join(dir, "missing.txt"), false, false); err == nil {
+		t.Error("addRulesFrom read a missing file")
+	}
+	bad := filepath.Join(dir, "bad.txt")
+	if err := ioutil.WriteFile(bad, []byte("[\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := addRulesFrom(bad, false, false); err == nil {
+		t.Error("addRulesFrom accepted the glob [")
+	}
+}
+
+func TestGlobMatch(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"tree/src/a.go": "",
+		"tree/src/b.md": "",
+		"tree/doc/c.go": "",
+	})
+	t.Chdir(dir)
+	tests := []struct {
+		mode string
+		glob string
+		want []string
+	}{
+		{"basename", "*.go", []string{"doc/c.go", "src/a.go"}},
+		{"basename", "src/*.go", nil},
+		{"relative", "src/*.go", []string{"src/a.go"}},
+		{"relative", "*.go", nil},
+		{"absolute", filepath.Join(dir, "tree/src/*"), []string{"src/a.go", "src/b.md"}},
+		{"absolute", "src/*", nil},
+	}
+	for _, root := range []string{"tree", filepath.Join(dir, "tree")} {
+		for _, test := range tests {
+			setFlags(t, "r", "true", "glob-match", test.mode, "include", test.glob)
+			var want []string
+			for _, name := range test.want {
+				want = append(want, filepath.Join(root, name))
+			}
+			if got := inputFiles([]string{root}); !reflect.DeepEqual(got, want) {
+				t.Errorf("-glob-match %s -include %s in %s found %q, want %q", test.mode, test.glob, root, got, want)
+			}
+		}
+	}
+}
+
+func TestRulePrecedence(t *testing.T) {
+	tests := []struct {
+		rules []string
+		name  string
+		want  bool
+	}{
+		{nil, "dir/a.go", true},
+		{[]string{"include", "*.go"}, "dir/a.go", true},
+		{[]string{"include", "*.go"}, "dir/a.md", false},
+		{[]string{"exclude", "*.go"}, "dir/a.go", false},
+		{[]string{"exclude", "*.go"}, "dir/a.md", true},
+		{[]string{"include", "*.go", "include", "*.md"}, "dir/a.md", true},
+		// an exclude wins over an include, whichever comes first
+		{[]string{"include", "*.go", "exclude", "a*"}, "dir/a.go", false},
+		{[]string{"exclude", "a*", "include", "*.go"}, "dir/a.go", false},
+		{[]string{"exclude", "a*", "include", "*.go"}, "dir/b.go", true},
+		// and even over a later -glob
+		{[]string{"exclude", "*.md", "glob", "*.md"}, "dir/a.md", false},
+		// but the last -glob a file matches decides
+		{[]string{"glob", "*.go", "glob", "!a*"}, "dir/a.go", false},
+		{[]string{"glob", "*.go", "glob", "!a*"}, "dir/b.go", true},
+		{[]string{"glob", "!a*", "glob", "*.go"}, "dir/a.go", true},
+		{[]string{"glob", "!a*", "glob", "*.go"}, "dir/a.md", false},
+		// with only exclusions, files no rule matches are searched
+		{[]string{"glob", "!*.md"}, "dir/a.go", true},
+		{[]string{"glob", "!*.md"}, "dir/a.md", false},
+	}
+	for _, test := range tests {
+		setFlags(t, test.rules...)
+		if got := included(test.name, test.name); got != test.want {
+			t.Errorf("%q included %s: %v, want %v", test.rules, test.name, got, test.want)
+		}
+	}
+}
+
+func TestFilenamePattern(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"tree/main.go":      "",
+		"tree/main_test.go": "",
+		"tree/util.go":      "",
+		"tree/sub/mainx.go": "",
+		"other.go":          "",
+	})
+	tree := filepath.Join(dir, "tree")
+	setFlags(t, "r", "true", "report-skipped", "true", "filename-pattern", `^main.*\.go$`)
+	if err := checkFilters(); err != nil {
+		t.Fatal(err)
+	}
+	got := inputFiles([]string{tree, filepath.Join(dir, "other.go")})
+	want := []string{tree + "/main.go", tree + "/main_test.go", tree + "/sub/mainx.go"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("-filename-pattern found %q, want %q", got, want)
+	}
+	// only the files found are ever opened
+	wantSkips := []skip{
+		{tree + "/util.go", "filtered out by -filename-pattern"},
+		{filepath.Join(dir, "other.go"), "filtered out by -filename-pattern"},
+	}
+	if !reflect.DeepEqual(skips, wantSkips) {
+		t.Errorf("-filename-pattern skipped %q, want %q", skips, wantSkips)
+	}
+
+	setFlags(t, "filename-pattern", "(")
+	if err := checkFilters(); err == nil {
+		t.Error("checkFilters accepted the -filename-pattern (")
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// followInterval is how often a followed file is checked for new lines.
+const followInterval = 250 * time.Millisecond
+
+var (
+	follow        = flag.String("follow-file", "", "Search this file, then keep reading lines as they are appended to it (like tail -f), until interrupted")
+	countInterval = flag.Duration("count-interval", 0, "With -follow-file and -c, print the number of lines selected so far at most this often (e.g. 5s), whenever it has changed")
+)
+
+// followLines is the number of lines selected so far in the followed
+// file, for count-interval.  Like remaining, it is only used by the
+// goroutine doing the search.
+var followLines int
+
+// followFile searches the file name like searchFile, but instead of
+// stopping at the end it waits for more to be written, so it only returns
+// early (because of the limit flag or a binary match) or on an error.
+func followFile(name, pattern string, c chan *match) (scanResult, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return scanResult{}, err
+	}
+	r := &followReader{name: name, file: file, c: c, counted: -1}
+	// reopen replaces r.file when the file is rotated, so it's the last
+	// one opened that is closed
+	defer func() { r.file.Close() }()
+	if *skipBytes > 0 {
+		r.offset, _ = file.Seek(*skipBytes, io.SeekStart)
+	}
+	return scanFile(name, withByteLimit(r), pattern, binaryAuto, c)
+}
+
+// A followReader reads the file called name, and when it reaches the end
+// waits for more to be appended rather than returning io.EOF.  If the file
+// is truncated it starts again from the beginning, and if name is replaced
+// by a new file (as when logs are rotated) it reopens it.
+type followReader struct {
+	name   string
+	file   *os.File
+	offset int64 // how far into file has been read
+
+	// for count-interval, where counts are sent, and the count last sent
+	// and when
+	c         chan *match
+	counted   int
+	countedAt time.Time
+}
+
+func (f *followReader) Read(p []byte) (int, error) {
+	for {
+		n, err := f.file.Read(p)
+		f.offset += int64(n)
+		if n > 0 || err != io.EOF {
+			return n, err
+		}
+		// the scanner only reads again once it has used up what it had,
+		// so every line so far has been searched
+		f.sendCount()
+		time.Sleep(followInterval)
+		if err := f.reopen(); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// sendCount sends followLines to c, if the count-interval flag is set and
+// the count has changed since it was last sent, at least count-interval ago.
+func (f *followReader) sendCount() {
+	if *countInterval <= 0 || followLines == f.counted || time.Since(f.countedAt) < *countInterval {
+		return
+	}
+	f.c <- &match{f.name, fmt.Sprintf("%*d", *countWidth, followLines)}
+	f.counted, f.countedAt = followLines, time.Now()
+}
+
+// reopen checks whether the file has been truncated or replaced since it
+// was last read, and if so starts reading it again from the beginning.
+func (f *followReader) reopen() error {
+	info, err := os.Stat(f.name)
+	if err != nil {
+		// the file is between being moved away and recreated
+		return nil
+	}
+	current, err := f.file.Stat()
+	if err != nil {
+		return err
+	}
+	if !os.SameFile(info, current) {
+		file, err := os.Open(f.name)
+		if err != nil {
+			return nil
+		}
+		f.file.Close()
+		f.file, f.offset = file, 0
+		return nil
+	}
+	if info.Size() < f.offset {
+		f.offset, err = f.file.Seek(0, io.SeekStart)
+	}
+	return err
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// readWithin reads from r until it has read want, failing the test if that
+// takes longer than a few polls of the file.
+func readWithin(t *testing.T, r io.Reader, want string) {
+	t.Helper()
+	got := make(chan string)
+	go func() {
+		buf := make([]byte, len(want))
+		n, _ := io.ReadFull(r, buf)
+		got <- string(buf[:n])
+	}()
+	select {
+	case s := <-got:
+		if s != want {
+			t.Errorf("read %q, want %q", s, want)
+		}
+	case <-time.After(10 * followInterval):
+		t.Fatalf("still waiting to read %q", want)
+	}
+}
+
+func TestFollowReader(t *testing.T) {
+	setFlags(t)
+	name := filepath.Join(t.TempDir(), "log")
+	writeFile := func(flags int, contents string) {
+		file, err := os.OpenFile(name, flags|os.O_WRONLY|os.O_CREATE, 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer file.Close()
+		if _, err := file.WriteString(contents); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeFile(os.O_TRUNC, "one\n")
+	file, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &followReader{name: name, file: file, counted: -1}
+	defer func() { r.file.Close() }()
+
+	readWithin(t, r, "one\n")
+	// appended
+	writeFile(os.O_APPEND, "two\n")
+	readWithin(t, r, "two\n")
+	// truncated, then written again
+	writeFile(os.O_TRUNC, "three\n")
+	readWithin(t, r, "three\n")
+	// rotated, with a new file in its place
+	if err := os.Rename(name, name+".1"); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(os.O_TRUNC, "four\n")
+	readWithin(t, r, "four\n")
+	if r.file == file {
+		t.Error("the rotated file wasn't reopened")
+	}
+}
+
+func TestFollowFile(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "log")
+	if err := ioutil.WriteFile(name, []byte("foo1\nbar\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	setFlags(t, "follow-file", name, "limit", "3")
+	remaining = 3
+	c := make(chan *match)
+	done := make(chan error)
+	go func() {
+		_, err := followFile(name, "foo", c)
+		done <- err
+	}()
+	var lines []string
+	appends := []string{"bar\nfoo2\n", "foo3\nfoo4\n"}
+	for len(lines) < 3 {
+		select {
+		case m := <-c:
+			lines = append(lines, m.line)
+			if len(appends) > 0 {
+				f, err := os.OpenFile(name, os.O_APPEND|os.O_WRONLY, 0666)
+				if err != nil {
+					t.Fatal(err)
+				}
+				f.WriteString(appends[0])
+				f.Close()
+				appends = appends[1:]
+			}
+		case <-time.After(10 * followInterval):
+			t.Fatalf("got %q, then nothing", lines)
+		}
+	}
+	if err := <-done; err != nil {
+		t.Errorf("followFile failed: %v", err)
+	}
+	if want := []string{"foo1", "foo2", "foo3"}; !reflect.DeepEqual(lines, want) {
+		t.Errorf("followFile sent %q, want %q", lines, want)
+	}
+}
+
+func TestSendCount(t *testing.T) {
+	setFlags(t, "count-interval", "1s")
+	c := make(chan *match, 10)
+	r := &followReader{name: "log", c: c, counted: -1}
+	steps := []struct {
+		lines int
+		ago   time.Duration // how long ago the last count was sent
+		want  string        // the count sent, if any
+	}{
+		// the first count is sent straight away, even if it's 0
+		{0, 0, "0"},
+		{2, 0, ""},
+		{2, 2 * time.Second, "2"},
+		{2, 2 * time.Second, ""},
+		{3, 500 * time.Millisecond, ""},
+		{3, time.Second, "3"},
+	}
+	for i, step := range steps {
+		followLines = step.lines
+		if i > 0 {
+			r.countedAt = time.Now().Add(-step.ago)
+		}
+		r.sendCount()
+		got := ""
+		select {
+		case m := <-c:
+			got = m.line
+		default:
+		}
+		if got != step.want {
+			t.Errorf("step %d sent %q, want %q", i, got, step.want)
+		}
+	}
+}
+
+func TestFollowCount(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "log")
+	if err := ioutil.WriteFile(name, []byte("foo\nbar\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	setFlags(t, "follow-file", name, "c", "true", "count-interval", "10ms", "limit", "3")
+	remaining = 3
+	c := make(chan *match)
+	done := make(chan error)
+	go func() {
+		_, err := followFile(name, "foo", c)
+		done <- err
+	}()
+	for _, want := range []string{"1", "2"} {
+		select {
+		case m := <-c:
+			if m.line != want {
+				t.Errorf("-count-interval sent %q, want %q", m.line, want)
+			}
+		case <-time.After(10 * followInterval):
+			t.Fatalf("still waiting for a count of %s", want)
+		}
+		f, err := os.OpenFile(name, os.O_APPEND|os.O_WRONLY, 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.WriteString("bar\nfoo\n")
+		f.Close()
+	}
+	// the third line used up the limit
+	if err := <-done; err != nil {
+		t.Errorf("followFile failed: %v", err)
+	}
+}
@@ -2,24 +2,120 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net/url"
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
+	"unicode"
 	"unicode/utf8"
 )
 
 var (
-	recurse    = flag.Bool("r", false, "For each directory operand, read and process all files in the directory, recursively")
+	recurse    = flag.Bool("r", false, "For each directory operand, read and process all files in the directory, recursively, skipping symbolic links")
+	newerThan  = flag.String("newer-than", "", "Only search files modified within this duration (e.g. 24h) or since this RFC3339 timestamp")
+	maxDepth   = flag.Int("max-depth", -1, "With -r or -R, descend at most this many directory levels below each directory operand (1 searches only the files directly inside it, negative means no limit)")
 	ignoreCase = flag.Bool("i", false, "Ignore case distinctions in both the pattern and input files")
 	invert     = flag.Bool("v", false, "Invert the sense of matching, to select non matching lines")
 	wholeLine  = flag.Bool("x", false, "Select only those matches that exactly match the whole line")
+	prefix     = flag.String("pattern-prefix", "", "Text to add before the pattern, e.g. 'func '")
+	suffix     = flag.String("pattern-suffix", "", "Text to add after the pattern")
+	trim       = flag.Bool("trim", true, "Trim leading and trailing whitespace from each line before matching (use -trim=false to match lines as they are)")
+	skipEmpty  = flag.Bool("skip-empty-lines", false, "Ignore empty lines (after trimming) entirely, so they are neither selected nor counted, even with -v")
+	trimCR     = flag.Bool("trim-cr", false, "Strip a trailing carriage return from each line before matching, leaving other whitespace alone")
+
+	asciiOnly   = flag.Bool("ascii-only", false, "Fail if the pattern isn't pure ASCII, and with -i only fold the case of ASCII letters in lines, which is faster")
+	trimDisplay = flag.Bool("trim-display", false, "Match lines as they are, like -trim=false, but trim leading and trailing whitespace from the lines printed")
+
+	dereference     = flag.Bool("R", false, "Like -r, but follow all symbolic links")
+	followFileLinks = flag.Bool("follow-file-symlinks", false, "Like -r, but search files that symbolic links point to (still never following links to directories)")
+	allowDuplicates = flag.Bool("allow-symlink-duplicates", false, "With -R or -follow-file-symlinks, search a file again each time a different link leads to it")
+
+	count             = flag.Bool("c", false, "Print only the number of selected lines in each file")
+	filesWithMatches  = flag.Bool("l", false, "Print only the names of files that contain a match")
+	filesWithoutMatch = flag.Bool("L", false, "Print only the names of files that don't contain a match")
+	firstFile         = flag.Bool("first-file", false, "Like -l, but stop searching after the first file that contains a match")
+	listFiles         = flag.Bool("files", false, "Print the names of the files that would be searched, without searching them (no PATTERN is given)")
+	capPerType        = flag.Int("cap-per-type", 0, "Stop searching files with a given extension once this many of them have contained a match, but carry on with other extensions (0 means no cap)")
+	limit             = flag.Int("limit", 0, "Stop searching after this many lines have been selected across all files, and say so on stderr (0 means no limit)")
+	allLinesMatch     = flag.Bool("all-lines-match", false, "With -l or -L, a file only counts as matching if every line in it matches")
+	totalMatches      = flag.Bool("total-matches", false, "Print only the total number of occurrences of the pattern across all files (with -v or -x, each selected line counts once)")
+	firstMatchOffset  = flag.Bool("first-match-offset", false, "For each file that contains a match, print only the byte offset of its first match")
+	capPerFile        = flag.Int("cap-per-file", 0, "Print at most this many selected lines from each file, followed by a [+N more] note, while still searching the whole file for the counts (0 means no cap)")
+	byteCount         = flag.Bool("bytes", false, "Like -c, but print the number of bytes in the selected lines of each file (like wc -c, so newlines count)")
+	countTotal        = flag.Bool("total", false, "With -c or -bytes, end the output with a total:N line summing the counts of all files")
+	countWidth        = flag.Int("count-width", 0, "With -c, right-align the counts printed to at least this many characters, so they line up")
+
+	stripPrefix       = flag.String("strip-prefix", "", "Remove this prefix from file names when printing them")
+	filenameTemplate  = flag.String("filename-template", "", "Print file names through this template, where {path} is replaced by the name (e.g. https://example.com/src/{path})")
+	hyperlink         = flag.Bool("hyperlink", false, "Make printed file names clickable links in terminals that support OSC 8 hyperlinks")
+	hyperlinkFormat   = flag.String("hyperlink-format", defaultHyperlinkFormat, "The target of -hyperlink links, where {path} is replaced by the file's absolute path (the default makes a file URL, with the path escaped)")
+	raw               = flag.Bool("raw", false, "Print only the original bytes of each selected line, without a file name, trimming or binary detection")
+	failOnMatch       = flag.Bool("fail-on-match", false, "Invert the exit status: exit with 1 if anything was selected (still printing it) and 0 if nothing was")
+	exitCount         = flag.Bool("exit-count", false, "Exit with the number of files that contained a match (at most 125) instead of 0 or 1, or with 126 if the search failed (bad options still exit with 2)")
+	noMatchMessage    = flag.String("no-match-message", "", "Print this message to stderr if nothing was selected")
+	showDepth         = flag.Bool("show-depth", false, "Prefix each printed file name with how many directory levels below its operand the file was found, like [2] (0 for the operands themselves)")
+	noTrailingNewline = flag.Bool("no-trailing-newline", false, "Separate output records with newlines instead of ending each one with a newline, so there is no newline after the last")
+
+	outputBufferSize = flag.Int("output-buffer-size", 64*1024, "Size in bytes of the buffer output is written through (it is flushed after every record when stdout is a terminal)")
+	tee              = flag.String("tee", "", "Also write all output to this file")
+
+	scanBufferSize = flag.Int("scan-buffer-size", bufio.MaxScanTokenSize, "Initial size in bytes of the buffer input is read through (it grows to fit longer lines, up to 64MB or this size if larger)")
+	verbose        = flag.Bool("verbose", false, "Print notes about the search to stderr")
+	checkPattern   = flag.Bool("check-pattern", false, "Only check the pattern and options, exiting with 0 if they are valid and 2 (saying why) if not, without searching anything")
+	showConfig     = flag.Bool("show-config", false, "Print the value of every option, and whether it was set on the command line or is the default, then exit")
+
+	showStats    = flag.Bool("stats", false, "After searching, print to stderr how many files were searched and matched, and how many lines and matches were found")
+	statsByExt   = flag.Bool("stats-by-ext", false, "Like -stats, but also break the number of matches down by file extension")
+	summaryJSON  = flag.Bool("summary-json", false, "After searching, print the -stats counts, bytes read, elapsed time and error count to stderr as a single JSON object")
+	showProgress = flag.Bool("progress", false, "When stderr is a terminal, show how many files have been searched and matches found so far")
+	fileTimeout  = flag.Duration("per-file-timeout", 0, "Give up on any file that takes longer than this to search (e.g. 10s), and exit with status 2 at the end")
+	maxBytes     = flag.Int64("max-bytes-scanned", 0, "Abort the whole search, with exit status 2, once this many bytes have been read from all inputs together (0 means no limit)")
+	skipBytes    = flag.Int64("skip-bytes", 0, "Skip this many bytes at the start of every input before searching it (byte offsets still count from the start of the input)")
+	stdinBinary  = flag.String("stdin-binary", "auto", "How to treat stdin: auto (look for NUL bytes in the first chunk read), text or binary")
+	binaryScan   = flag.Int("binary-scan-bytes", 8192, "Treat any input with a NUL byte in its first this many bytes as binary (of stdin, only as many as the first read returns, so a slow stream isn't waited for), or 0 to not look for NUL bytes")
+
+	reportSkipped = flag.Bool("report-skipped", false, "At the end, list on stderr every file that wasn't searched (or only partly), and why")
 )
 
+// remaining is the number of lines that can still be selected before the
+// limit flag stops the search (negative if there's no limit).  It is only
+// used by the goroutine doing the search, and by main once it has finished.
+var remaining = -1
+
+// limitCut is set once the limit flag has stopped a file being searched
+// with some of it still unread.  Like remaining, it is only used by the
+// goroutine doing the search, and by main once it has finished.
+var limitCut bool
+
+// depths holds how many directory levels below its operand each file
+// found by a recursive search is, for the show-depth flag (operands aren't
+// in it, as their depth is 0).  It is only written while the list of files
+// is built.
+var depths = make(map[string]int)
+
+// stdinOnly is set when stdin is the only input, so -c prints its count
+// on its own, like GNU grep does, with no "stdin" label.
+var stdinOnly bool
+
+// modifiedSince is the time parsed from the newer-than flag
+// (the zero time if it isn't set).
+var modifiedSince time.Time
+
+func init() {
+	flag.BoolVar(dereference, "dereference-recursive", false, "Same as -R")
+}
+
 // Program exit codes
 const (
 	exitMatchesFound int = 0
@@ -27,14 +123,93 @@ const (
 	exitError        int = 2
 )
 
+// With -exit-count the exit status is the number of files that matched,
+// up to maxExitCount, or exitCountError if something went wrong.
+const (
+	maxExitCount   = 125
+	exitCountError = 126
+)
+
+// defaultHyperlinkFormat is the default hyperlink-format, for which link
+// builds a proper file URL rather than just putting the path in.
+const defaultHyperlinkFormat = "file://{path}"
+
+// maxLineSize is the longest line scanFile can search, unless the
+// scan-buffer-size flag is larger.  Past this, the rest of the file is skipped.
+const maxLineSize = 64 << 20
+
+// binaryMode controls how scanFile decides whether its input is binary.
+type binaryMode int
+
+const (
+	binaryAuto   binaryMode = iota // lines that aren't valid utf8 are binary
+	binaryText                     // never treat the input as binary
+	binaryAlways                   // the whole input is binary
+)
+
 // A match represents a line in a particular file that matched the search pattern.
+// When only file names are being printed (-l, -L, -files), line is unused.
 type match struct {
 	file string
 	line string
 }
 
 func (m *match) String() string {
-	return m.file + ": " + m.line
+	name := link(m.file)
+	if *showDepth {
+		name = fmt.Sprintf("[%d] %s", depths[m.file], name)
+	}
+	if listingFiles() {
+		return name
+	}
+	if *raw || (*count && stdinOnly) {
+		return m.line
+	}
+	return name + ": " + m.line
+}
+
+// link returns the display name of a file, wrapped in an OSC 8 escape
+// sequence that links to the file if the hyperlink flag is set.
+func link(file string) string {
+	name := displayName(file)
+	if !*hyperlink || file == "stdin" {
+		return name
+	}
+	abs, err := filepath.Abs(file)
+	if err != nil {
+		return name
+	}
+	target := strings.Replace(*hyperlinkFormat, "{path}", filepath.ToSlash(abs), -1)
+	if *hyperlinkFormat == defaultHyperlinkFormat {
+		target = fileURL(filepath.ToSlash(abs))
+	}
+	return "\x1b]8;;" + target + "\x1b\\" + name + "\x1b]8;;\x1b\\"
+}
+
+// fileURL returns the file URL for the absolute, slash-separated path
+// name.  The path is escaped, so that a # or % in it isn't read as
+// anything else, and a Windows drive path gets a / before it, as in
+// file:///C:/dir.
+func fileURL(name string) string {
+	if !strings.HasPrefix(name, "/") {
+		name = "/" + name
+	}
+	return (&url.URL{Scheme: "file", Path: name}).String()
+}
+
+// displayName returns a file name the way it should be printed, after
+// applying the strip-prefix and filename-template flags.
+func displayName(file string) string {
+	file = strings.TrimPrefix(file, *stripPrefix)
+	if *filenameTemplate != "" {
+		file = strings.Replace(*filenameTemplate, "{path}", file, -1)
+	}
+	return file
+}
+
+// listingFiles reports whether output consists of file names rather than lines.
+func listingFiles() bool {
+	return *filesWithMatches || *filesWithoutMatch || *listFiles
 }
 
 // TODO
@@ -43,72 +218,649 @@ func (m *match) String() string {
 // - parallelize for performance
 
 func main() {
+	start := time.Now()
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "Usage: grep [options] <PATTERN> [INPUT_FILES]\n")
 		fmt.Fprintf(os.Stderr, "Options:\n")
 		flag.PrintDefaults()
 	}
 	flag.Parse()
-	if flag.NArg() < 1 {
+	if *showConfig {
+		printConfig(os.Stdout)
+		os.Exit(exitMatchesFound)
+		return
+	}
+	if flag.NArg() < 1 && !*listFiles {
 		flag.Usage()
 		os.Exit(exitError)
 		return
 	}
+	if *filesWithMatches && *filesWithoutMatch {
+		fmt.Fprintf(os.Stderr, "-l and -L can't be used together\n")
+		os.Exit(exitError)
+		return
+	}
+	if *followFileLinks {
+		*recurse = true
+	}
+	if *firstFile {
+		if *filesWithoutMatch {
+			fmt.Fprintf(os.Stderr, "-first-file and -L can't be used together\n")
+			os.Exit(exitError)
+			return
+		}
+		*filesWithMatches = true
+	}
+	// these stop reading a file at its first match (or, like -files, don't
+	// read it at all), so they'd miss the occurrences after it
+	if *totalMatches && (listingFiles() || *firstMatchOffset) {
+		fmt.Fprintf(os.Stderr, "-total-matches can't be used with -l, -L, -files, -first-file or -first-match-offset\n")
+		os.Exit(exitError)
+		return
+	}
+	if *allLinesMatch && !*filesWithMatches && !*filesWithoutMatch {
+		fmt.Fprintf(os.Stderr, "-all-lines-match needs -l or -L\n")
+		os.Exit(exitError)
+		return
+	}
+	if *exitCount && *failOnMatch {
+		fmt.Fprintf(os.Stderr, "-exit-count and -fail-on-match can't be used together\n")
+		os.Exit(exitError)
+		return
+	}
+	if *byteCount {
+		if *count || *follow != "" {
+			fmt.Fprintf(os.Stderr, "-bytes can't be used with -c or -follow-file\n")
+			os.Exit(exitError)
+			return
+		}
+		*count = true
+	}
+	if *countTotal && (!*count || listingFiles()) {
+		fmt.Fprintf(os.Stderr, "-total needs -c or -bytes\n")
+		os.Exit(exitError)
+		return
+	}
+	if *follow != "" && (listingFiles() || *totalMatches) {
+		fmt.Fprintf(os.Stderr, "-follow-file can't be used with -l, -L, -files or -total-matches\n")
+		os.Exit(exitError)
+		return
+	}
+	if *countInterval < 0 {
+		fmt.Fprintf(os.Stderr, "Invalid value for -count-interval: %s\n", *countInterval)
+		os.Exit(exitError)
+		return
+	}
+	if *countInterval > 0 && (*follow == "" || !*count) {
+		fmt.Fprintf(os.Stderr, "-count-interval needs -follow-file and -c\n")
+		os.Exit(exitError)
+		return
+	}
+	if *follow != "" && *count && *countInterval == 0 {
+		fmt.Fprintf(os.Stderr, "-c with -follow-file needs -count-interval, as the file never ends\n")
+		os.Exit(exitError)
+		return
+	}
+	if *reverse && (*firstMatchOffset || *follow != "") {
+		fmt.Fprintf(os.Stderr, "-reverse can't be used with -first-match-offset or -follow-file\n")
+		os.Exit(exitError)
+		return
+	}
+	if *dedupeCount {
+		if *follow != "" {
+			fmt.Fprintf(os.Stderr, "-dedupe-count and -follow-file can't be used together\n")
+			os.Exit(exitError)
+			return
+		}
+		*dedupe = true
+	}
+	if *dedupe && (listingFiles() || *count || *totalMatches || *firstMatchOffset) {
+		fmt.Fprintf(os.Stderr, "-dedupe can't be used with -c, -l, -L, -files, -first-match-offset or -total-matches\n")
+		os.Exit(exitError)
+		return
+	}
+	if *outputDir != "" && (listingFiles() || *totalMatches) {
+		fmt.Fprintf(os.Stderr, "-output-dir can't be used with -l, -L, -files or -total-matches\n")
+		os.Exit(exitError)
+		return
+	}
+	switch *stdinBinary {
+	case "auto", "text", "binary":
+	default:
+		fmt.Fprintf(os.Stderr, "Invalid value for -stdin-binary: %s\n", *stdinBinary)
+		os.Exit(exitError)
+		return
+	}
+
+	if *outputBufferSize < 1 {
+		fmt.Fprintf(os.Stderr, "Invalid value for -output-buffer-size: %d\n", *outputBufferSize)
+		os.Exit(exitError)
+		return
+	}
+	if *countWidth < 0 {
+		fmt.Fprintf(os.Stderr, "Invalid value for -count-width: %d\n", *countWidth)
+		os.Exit(exitError)
+		return
+	}
+	if *binaryScan < 0 {
+		fmt.Fprintf(os.Stderr, "Invalid value for -binary-scan-bytes: %d\n", *binaryScan)
+		os.Exit(exitError)
+		return
+	}
+	// the [+N more] note would be mixed in with the lines' original bytes
+	if *capPerFile > 0 && *raw {
+		fmt.Fprintf(os.Stderr, "-cap-per-file can't be used with -raw\n")
+		os.Exit(exitError)
+		return
+	}
+	if *capPerType < 0 {
+		fmt.Fprintf(os.Stderr, "Invalid value for -cap-per-type: %d\n", *capPerType)
+		os.Exit(exitError)
+		return
+	}
+	if *capPerFile < 0 {
+		fmt.Fprintf(os.Stderr, "Invalid value for -cap-per-file: %d\n", *capPerFile)
+		os.Exit(exitError)
+		return
+	}
+	if *limit < 0 {
+		fmt.Fprintf(os.Stderr, "Invalid value for -limit: %d\n", *limit)
+		os.Exit(exitError)
+		return
+	}
+	if *limit > 0 {
+		remaining = *limit
+	}
+	if *maxBytes < 0 {
+		fmt.Fprintf(os.Stderr, "Invalid value for -max-bytes-scanned: %d\n", *maxBytes)
+		os.Exit(exitError)
+		return
+	}
+	if *skipBytes < 0 {
+		fmt.Fprintf(os.Stderr, "Invalid value for -skip-bytes: %d\n", *skipBytes)
+		os.Exit(exitError)
+		return
+	}
+	if *scanBufferSize < 1 {
+		fmt.Fprintf(os.Stderr, "Invalid value for -scan-buffer-size: %d\n", *scanBufferSize)
+		os.Exit(exitError)
+		return
+	}
+	if err := checkFilters(); err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		os.Exit(exitError)
+		return
+	}
+	if *newerThan != "" {
+		since, err := parseSince(*newerThan, time.Now())
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid value for -newer-than: %s\n", *newerThan)
+			os.Exit(exitError)
+			return
+		}
+		modifiedSince = since
+	}
 
-	files := inputFiles(flag.Args()[1:])
+	// with -files there is no pattern, every argument is an input file
+	pattern, operands := "", flag.Args()
+	if !*listFiles {
+		pattern, operands = *prefix+flag.Arg(0)+*suffix, flag.Args()[1:]
+	}
+
+	if *follow != "" && len(operands) > 0 {
+		fmt.Fprintf(os.Stderr, "-follow-file takes no other input files\n")
+		os.Exit(exitError)
+		return
+	}
+	if *asciiOnly && !isASCII(pattern) {
+		fmt.Fprintf(os.Stderr, "-ascii-only was given, but the pattern isn't ASCII: %q\n", pattern)
+		os.Exit(exitError)
+		return
+	}
+	if *verbose && *ignoreCase && !*asciiOnly && isASCII(pattern) {
+		fmt.Fprintf(os.Stderr, "the pattern is ASCII, so if the input is too, -ascii-only would make -i faster\n")
+	}
+	stdinOperands := 0
+	for _, operand := range operands {
+		if operand == "-" {
+			stdinOperands++
+		}
+	}
+	if stdinOperands > 1 {
+		fmt.Fprintf(os.Stderr, "- (stdin) can only be given once\n")
+		os.Exit(exitError)
+		return
+	}
+	// everything that can be checked without reading anything has been
+	if *checkPattern {
+		os.Exit(exitMatchesFound)
+		return
+	}
+
+	files := inputFiles(operands)
+	// with no file operands, we search stdin
+	if len(operands) == 0 && !*listFiles {
+		files = []string{"-"}
+	}
+	stdinOnly = *follow == "" && len(files) == 1 && files[0] == "-"
+	var split *splitOutput
+	if *outputDir != "" {
+		written := files
+		if *follow != "" {
+			written = []string{*follow}
+		}
+		paths, err := outputPaths(*outputDir, written)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+			os.Exit(exitError)
+			return
+		}
+		split = newSplitOutput(paths)
+	}
 	c := make(chan *match)
+	var prog *progress
+	if *progressJSON {
+		prog = newJSONProgress(os.Stderr)
+	} else if *showProgress {
+		prog = newProgress(os.Stderr)
+	}
+
+	var stdout io.Writer = os.Stdout
+	if *tee != "" {
+		// the inputs are already listed, so if the tee file were one of them
+		// it would be emptied and then read back as it was written
+		inputs := files
+		if *follow != "" {
+			inputs = []string{*follow}
+		}
+		teePath := realPath(*tee)
+		for _, file := range inputs {
+			if file != "-" && realPath(file) == teePath {
+				fmt.Fprintf(os.Stderr, "-tee: %s would overwrite the input %s\n", *tee, file)
+				os.Exit(exitError)
+				return
+			}
+		}
+		teeFile, err := os.Create(*tee)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+			os.Exit(exitError)
+			return
+		}
+		stdout = io.MultiWriter(os.Stdout, teeFile)
+	}
+	out := bufio.NewWriterSize(stdout, *outputBufferSize)
+	// matches from a followed file are wanted as soon as they arrive,
+	// even when they're going into a pipe
+	lineBuffered := isTerminal(os.Stdout) || *follow != ""
+
+	// totals sums up the search, unsearched counts the files skipped
+	// because of the limit flag, timedOut is set if a file took too long
+	// and tooMuchInput if max-bytes-scanned was hit (they are only read
+	// once c is closed), and followFailed is set if -follow-file couldn't
+	// be read
+	var totals runStats
+	typeMatches := make(map[string]int) // matching files by extension, for -cap-per-type
+	followFailed := false
+	unsearched := 0
+	timedOut := false
+	tooMuchInput := false
 
 	// kick off a goroutine that performs the search and writes matches to c
-	// (we either search stdin or a set of files)
+	// (we either search stdin, if no files were given, or a set of files)
 	go func() {
-		if len(files) == 0 {
-			scanFile("stdin", os.Stdin, flag.Arg(0), c)
-		} else {
+		if *listFiles {
 			for _, filename := range files {
-				file, err := os.Open(filename)
+				c <- &match{file: filename}
+			}
+		} else if *follow != "" {
+			if _, err := followFile(*follow, pattern, c); err != nil {
+				fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+				errorCount++
+				followFailed = true
+			}
+		} else {
+			for i, filename := range files {
+				if remaining == 0 {
+					unsearched = len(files) - i
+					skippedAll(files[i:], "not searched, -limit reached")
+					break
+				}
+				name := filename
+				if filename == "-" {
+					name = "stdin"
+				}
+				ext := filepath.Ext(name)
+				if *capPerType > 0 && typeMatches[ext] == *capPerType {
+					skipped(name, "not searched, -cap-per-type reached for "+ext)
+					continue
+				}
+				prog.startFile(name)
+				result, err := searchFile(filename, pattern, c)
+				if err == errTooMuchInput {
+					tooMuchInput = true
+					skipped(name, "partly searched, -max-bytes-scanned reached")
+					skippedAll(files[i+1:], "not searched, -max-bytes-scanned reached")
+					break
+				}
+				if err == errTimeout {
+					timedOut = true
+					errorCount++
+					if *verbose {
+						fmt.Fprintf(os.Stderr, "%s: skipped, still searching after %s\n", name, *fileTimeout)
+					}
+					skipped(name, "timed out after "+fileTimeout.String())
+				} else if err != nil {
+					errorCount++
+					// errors from opening or reading a file already name it
+					var pathErr *os.PathError
+					if errors.As(err, &pathErr) {
+						fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+					} else {
+						fmt.Fprintf(os.Stderr, "%s: %s\n", name, err.Error())
+					}
+					skipped(name, unreadable(err))
+				}
 				if err != nil {
 					continue
 				}
-				defer file.Close()
-				scanFile(filename, file, flag.Arg(0), c)
+				reportFile(name, result, c)
+				totals.add(name, result)
+				if result.fileMatches() {
+					typeMatches[ext]++
+				}
+				prog.endFile(result.lines)
+				if *firstFile && result.fileMatches() {
+					skippedAll(files[i+1:], "not searched, -first-file found a match")
+					break
+				}
 			}
+			sendDeduped(c)
 		}
 		close(c)
 	}()
 
 	// display matching lines.  a match is considered anything that procudes output
 	// (so if the invert flag is enabled, a match is actually a line that didn't
-	// match the specified pattern)
+	// match the specified pattern, and with -L it's a file without any matches)
 	matchFound := false
+	// printed is set once a record has been written to out, so that with
+	// no-trailing-newline the next one knows to end the line before it
+	printed := false
+	printRecord := func(record interface{}) {
+		if *noTrailingNewline {
+			if printed {
+				fmt.Fprintln(out)
+			}
+			fmt.Fprint(out, record)
+		} else {
+			fmt.Fprintln(out, record)
+		}
+		printed = true
+	}
 	for result := range c {
+		prog.output()
+		if *outputDir != "" {
+			if err := split.write(result); err != nil {
+				fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+				os.Exit(exitError)
+				return
+			}
+		} else {
+			printRecord(result)
+		}
+		if lineBuffered {
+			out.Flush()
+		}
 		if !matchFound {
 			matchFound = true
 		}
-		fmt.Println(result)
+	}
+	prog.done()
+	if err := split.close(); err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		os.Exit(exitError)
+		return
+	}
+	if *totalMatches {
+		printRecord(totals.occurrences)
+		matchFound = totals.occurrences > 0
+	}
+	// -c prints a count for every file, matching or not (but -l, -L and
+	// -files only list names, and exit 0 when they listed any)
+	if *count && !listingFiles() {
+		matchFound = totals.lines > 0
+	}
+	if *countTotal && *byteCount {
+		printRecord(fmt.Sprintf("total:%*d", *countWidth, totals.bytes))
+	} else if *countTotal {
+		printRecord(fmt.Sprintf("total:%*d", *countWidth, totals.lines))
 	}
 
+	// with fail-on-match (for linting), finding anything is the failure,
+	// but any input that couldn't be searched is an error either way
+	failed := tooMuchInput || timedOut || followFailed || errorCount > 0
 	var exit int
-	if matchFound {
+	if failed {
+		exit = exitError
+	} else if matchFound != *failOnMatch {
 		exit = exitMatchesFound
 	} else {
 		exit = exitNoMatches
 	}
+	if *exitCount {
+		exit = totals.filesMatched
+		if exit > maxExitCount {
+			exit = maxExitCount
+		}
+		if failed {
+			exit = exitCountError
+		}
+	}
+	out.Flush()
+	if !matchFound && *noMatchMessage != "" {
+		fmt.Fprintln(os.Stderr, *noMatchMessage)
+	}
+	if tooMuchInput {
+		fmt.Fprintf(os.Stderr, "Aborted after reading %d bytes\n", bytesRead)
+	}
+	if limitCut || unsearched > 0 {
+		fmt.Fprintf(os.Stderr, "Stopped after %d selected lines, leaving %d files unsearched\n", *limit, unsearched)
+	}
+	if *showStats || *statsByExt {
+		totals.print(os.Stderr)
+	}
+	if *summaryJSON {
+		totals.printJSON(os.Stderr, time.Since(start))
+	}
+	if *reportSkipped && len(skips) > 0 {
+		fmt.Fprintf(os.Stderr, "%d files skipped:\n", len(skips))
+		for _, s := range skips {
+			fmt.Fprintf(os.Stderr, "  %s: %s\n", s.name, s.reason)
+		}
+	}
 	os.Exit(exit)
 }
 
+// printConfig writes the value of every flag to w, saying where each
+// value came from, for the show-config flag.
+func printConfig(w io.Writer) {
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	flag.VisitAll(func(f *flag.Flag) {
+		source := "default"
+		if set[f.Name] {
+			source = "command line"
+		}
+		fmt.Fprintf(w, "-%s=%s (%s)\n", f.Name, f.Value, source)
+	})
+	// the include and exclude flags all add to one list of rules, so
+	// they're shown as it is
+	for _, r := range rules {
+		switch {
+		case r.final:
+			fmt.Fprintf(w, "rule: exclude %s, whatever later rules say\n", r.glob)
+		case r.exclude:
+			fmt.Fprintf(w, "rule: exclude %s\n", r.glob)
+		default:
+			fmt.Fprintf(w, "rule: include %s\n", r.glob)
+		}
+	}
+}
+
+// searchFile opens a single input file, where "-" means stdin, and scans
+// it with scanFile.
+func searchFile(filename, pattern string, c chan *match) (scanResult, error) {
+	if filename == "-" {
+		stdin, mode := stdinInput()
+		if *reverse {
+			// stdin can't be read backwards, so it's all read in first
+			data, err := ioutil.ReadAll(stdin)
+			if err != nil {
+				return scanResult{}, err
+			}
+			stdin = newReverseReader(bytes.NewReader(data), 0, int64(len(data)))
+		}
+		return scanFile("stdin", stdin, pattern, mode, c)
+	}
+	file, err := os.Open(filename)
+	if err != nil {
+		return scanResult{}, err
+	}
+	defer file.Close()
+	var r io.Reader = file
+	if *reverse {
+		info, err := file.Stat()
+		if err != nil {
+			return scanResult{}, err
+		}
+		r = newReverseReader(file, *skipBytes, info.Size())
+	} else if *skipBytes > 0 {
+		file.Seek(*skipBytes, io.SeekStart)
+	}
+	mode := binaryAuto
+	if binaryHead(file) {
+		mode = binaryAlways
+	}
+	return scanFile(filename, withByteLimit(withTimeout(r)), pattern, mode, c)
+}
+
+// bytesRead is the number of bytes read from all inputs so far.  Like
+// remaining, it is only used by the goroutine doing the search, and main
+// once that has finished.
+var bytesRead int64
+
+// errorCount is the number of inputs that couldn't be found or read, or
+// took too long.  It is added to while the list of files is built, then by
+// the goroutine doing the search, and only read by main once that has
+// finished.
+var errorCount int
+
+// errTooMuchInput is the error reading fails with once max-bytes-scanned
+// bytes have been read.
+var errTooMuchInput = errors.New("too much input")
+
+// withByteLimit returns a reader over r that adds what it reads to
+// bytesRead, failing with errTooMuchInput once more than the
+// max-bytes-scanned flag's limit would have to be read.
+func withByteLimit(r io.Reader) io.Reader {
+	return &countingReader{r}
+}
+
+// A countingReader is a Reader that keeps bytesRead up to date.
+type countingReader struct {
+	r io.Reader
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	if *maxBytes > 0 {
+		left := *maxBytes - bytesRead
+		if left <= 0 {
+			// an input that ends right at the limit isn't too much, so
+			// only fail if there's at least one more byte to read
+			n, err := c.r.Read(make([]byte, 1))
+			if n > 0 {
+				return 0, errTooMuchInput
+			}
+			return 0, err
+		}
+		if int64(len(p)) > left {
+			p = p[:left]
+		}
+	}
+	n, err := c.r.Read(p)
+	bytesRead += int64(n)
+	return n, err
+}
+
+// errTimeout is the error reading an input fails with once it has taken
+// longer than the per-file-timeout flag allows.
+var errTimeout = errors.New("timed out")
+
+// withTimeout returns a reader over r that starts failing with errTimeout
+// after the per-file-timeout flag's duration, or r itself if there's no
+// timeout.
+func withTimeout(r io.Reader) io.Reader {
+	if *fileTimeout <= 0 {
+		return r
+	}
+	return &deadlineReader{r, time.Now().Add(*fileTimeout)}
+}
+
+// A deadlineReader is a Reader that fails with errTimeout when read from
+// after its deadline.  A read that has already started is not interrupted.
+type deadlineReader struct {
+	r        io.Reader
+	deadline time.Time
+}
+
+func (d *deadlineReader) Read(p []byte) (int, error) {
+	if time.Now().After(d.deadline) {
+		return 0, errTimeout
+	}
+	return d.r.Read(p)
+}
+
+// reportFile writes the record printed for a whole file to c, if any: the
+// file name, if it should be listed by -l or -L, or its count for -c.
+func reportFile(filename string, result scanResult, c chan *match) {
+	found := result.fileMatches()
+	if *filesWithMatches || *filesWithoutMatch {
+		if (*filesWithMatches && found) || (*filesWithoutMatch && !found) {
+			c <- &match{file: filename}
+		}
+		return
+	}
+	if *byteCount {
+		c <- &match{filename, fmt.Sprintf("%*d", *countWidth, result.bytes)}
+	} else if *count {
+		c <- &match{filename, fmt.Sprintf("%*d", *countWidth, result.lines)}
+	}
+}
+
 // inputFiles generates the list of all files that must be searched,
 // given a particular set of input arguments.
 func inputFiles(input []string) []string {
 	var result []string
+	visited := make(map[string]bool)
 	// first get all the files in this directory that match the pattern
 	for _, glob := range input {
+		// stdin is searched in its place among the other inputs
+		if glob == "-" {
+			result = append(result, glob)
+			continue
+		}
 		items, err := filepath.Glob(glob)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "Error %s\n", err.Error())
+			errorCount++
 			continue
 		}
 		if items == nil {
 			fmt.Fprintf(os.Stderr, "No match for %s\n", glob)
+			errorCount++
 			continue
 		}
 		// for each glob match, add it to the search list if it is a regular file,
@@ -117,12 +869,23 @@ func inputFiles(input []string) []string {
 			fileInfo, err := os.Stat(file)
 			if err != nil {
 				fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+				errorCount++
+				skipped(file, unreadable(err))
 				continue
 			}
 			if fileInfo.Mode().IsRegular() {
-				result = append(result, file)
-			} else if fileInfo.Mode().IsDir() && *recurse {
-				files, err := getFilesInDir(file, true)
+				if wanted(file, file, fileInfo) {
+					result = append(result, file)
+				}
+			} else if !fileInfo.Mode().IsDir() {
+				skipped(file, "not a regular file")
+			} else if !*recurse && !*dereference {
+				skipped(file, "a directory (use -r to search it)")
+			} else if *maxDepth == 0 {
+				skipped(file, "a directory deeper than -max-depth")
+			} else {
+				searchRoots = append(searchRoots, file)
+				files, err := getFilesInDir(file, file, *maxDepth, visited)
 				if err == nil {
 					result = append(result, files...)
 				}
@@ -132,68 +895,515 @@ func inputFiles(input []string) []string {
 	return result
 }
 
+// parseSince parses the value of the newer-than flag, which is either a
+// duration before now or an RFC3339 timestamp.
+func parseSince(value string, now time.Time) (time.Time, error) {
+	if d, err := time.ParseDuration(value); err == nil {
+		return now.Add(-d), nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// wanted reports whether the regular file name, found under root, passes
+// the newer-than, include/exclude and filename-pattern filters, recording
+// why if it doesn't.
+func wanted(name, root string, info os.FileInfo) bool {
+	if !recentEnough(info) {
+		skipped(name, "filtered out by -newer-than")
+		return false
+	}
+	if !included(name, root) {
+		skipped(name, "filtered out by -include/-exclude/-glob")
+		return false
+	}
+	if !nameMatches(name) {
+		skipped(name, "filtered out by -filename-pattern")
+		return false
+	}
+	return true
+}
+
+// recentEnough reports whether a file was modified late enough to be
+// searched, according to the newer-than flag.
+func recentEnough(info os.FileInfo) bool {
+	return modifiedSince.IsZero() || info.ModTime().After(modifiedSince)
+}
+
 // getFilesInDir returns a slice containing the names of all regular files
-// in a particular directory, optionally recursing into subdirectories.
-// It does not follow symbolic links.
-func getFilesInDir(dir string, recurse bool) ([]string, error) {
+// in a particular directory, recursing into subdirectories until depth
+// levels have been read (a depth of 1 reads only dir itself, a negative
+// depth has no limit).  Symbolic links are skipped, unless the -R flag is
+// set, in which case they are followed, or -follow-file-symlinks, in which
+// case the ones to files are.  root is the directory operand dir was found
+// under, and visited holds the real paths of the directories and files
+// found so far while following links, so that links pointing back up the
+// tree are only read once, and files that several links lead to are only
+// searched once (unless allow-symlink-duplicates is set).
+func getFilesInDir(root, dir string, depth int, visited map[string]bool) ([]string, error) {
+	if *dereference {
+		first, err := firstVisit(dir, visited)
+		if err != nil {
+			errorCount++
+			skipped(dir, unreadable(err))
+			return nil, err
+		}
+		if !first {
+			skipped(dir, "a directory already read through another link")
+			return nil, nil
+		}
+	}
 	infos, err := ioutil.ReadDir(dir)
 	if err != nil {
+		errorCount++
+		skipped(dir, unreadable(err))
 		return nil, err
 	}
 	var results []string
 	for _, item := range infos {
+		name := path.Join(dir, item.Name())
+		if item.Mode()&os.ModeSymlink != 0 && (*dereference || *followFileLinks) {
+			target, err := os.Stat(name)
+			if err != nil {
+				// a dangling link
+				skipped(name, "a dangling symbolic link")
+				continue
+			}
+			if target.IsDir() && !*dereference {
+				skipped(name, "a symbolic link to a directory (use -R to follow it)")
+				continue
+			}
+			item = target
+		}
 		if item.Mode().IsRegular() {
-			results = append(results, path.Join(dir, item.Name()))
-		} else if item.IsDir() && recurse {
-			subdir, err := getFilesInDir(path.Join(dir, item.Name()), true)
+			if !wanted(name, root, item) {
+				continue
+			}
+			if (*dereference || *followFileLinks) && !*allowDuplicates {
+				first, err := firstVisit(name, visited)
+				if err != nil {
+					errorCount++
+					skipped(name, unreadable(err))
+					continue
+				}
+				if !first {
+					skipped(name, "already searched through another link")
+					continue
+				}
+			}
+			if *showDepth {
+				rel, _ := filepath.Rel(root, name)
+				depths[name] = strings.Count(filepath.ToSlash(rel), "/") + 1
+			}
+			if *outputDir != "" {
+				fileRoots[name] = root
+			}
+			results = append(results, name)
+		} else if item.IsDir() {
+			if depth == 1 {
+				skipped(name, "a directory deeper than -max-depth")
+				continue
+			}
+			subdir, err := getFilesInDir(root, name, depth-1, visited)
 			if err != nil {
 				// TODO: ignore??
 				continue
 			}
 			results = append(results, subdir...)
+		} else if item.Mode()&os.ModeSymlink != 0 {
+			skipped(name, "a symbolic link (use -R to follow it)")
+		} else {
+			skipped(name, "not a regular file")
 		}
 	}
 	return results, nil
 }
 
+// firstVisit adds the real path of name, with all symbolic links resolved,
+// to visited, and reports whether it wasn't already there.  The path is
+// made absolute, as a link with an absolute target resolves to an absolute
+// path even when name is relative.
+func firstVisit(name string, visited map[string]bool) (bool, error) {
+	real, err := filepath.EvalSymlinks(name)
+	if err != nil {
+		return false, err
+	}
+	if real, err = filepath.Abs(real); err != nil {
+		return false, err
+	}
+	if visited[real] {
+		return false, nil
+	}
+	visited[real] = true
+	return true, nil
+}
+
+// binaryHead reports whether there's a NUL byte in the first
+// binary-scan-bytes bytes of file, after any skipped bytes.  It reads them
+// with ReadAt, so it looks at the start of the file however it is going
+// to be read (-reverse reads it from the end).
+func binaryHead(file *os.File) bool {
+	if *binaryScan == 0 {
+		return false
+	}
+	head := make([]byte, *binaryScan)
+	n, _ := file.ReadAt(head, *skipBytes)
+	return bytes.IndexByte(head[:n], 0) >= 0
+}
+
+// stdinInput returns a buffered reader over stdin along with the binaryMode
+// it should be scanned with.  Since stdin can't be rewound, in auto mode the
+// first chunk read is kept in the buffer and checked for NUL bytes before
+// the scan consumes it.
+func stdinInput() (io.Reader, binaryMode) {
+	size := 4096
+	if *binaryScan > size {
+		size = *binaryScan
+	}
+	r := bufio.NewReaderSize(withByteLimit(withTimeout(os.Stdin)), size)
+	// skip the header before looking for NUL bytes, since that's where
+	// they're likely to be
+	if *skipBytes > 0 {
+		io.CopyN(ioutil.Discard, r, *skipBytes)
+	}
+	switch *stdinBinary {
+	case "text":
+		return r, binaryText
+	case "binary":
+		return r, binaryAlways
+	}
+	if *binaryScan == 0 {
+		return r, binaryAuto
+	}
+	// only look at what the first read returned, so that we don't block
+	// waiting for more input on an interactive or slow stream
+	r.Peek(1)
+	n := r.Buffered()
+	if n > *binaryScan {
+		n = *binaryScan
+	}
+	head, _ := r.Peek(n)
+	if bytes.IndexByte(head, 0) >= 0 {
+		return r, binaryAlways
+	}
+	return r, binaryAuto
+}
+
+// A skip is a file that wasn't searched, or only partly, and the reason.
+type skip struct {
+	name   string
+	reason string
+}
+
+// skips lists the files reported by the report-skipped flag.  It is added
+// to while the list of files is built, then by the goroutine doing the
+// search, and only read by main once that has finished.
+var skips []skip
+
+// skipped records that name was skipped for reason, if report-skipped is set.
+func skipped(name, reason string) {
+	if *reportSkipped {
+		skips = append(skips, skip{name, reason})
+	}
+}
+
+// skippedAll records that every file in names was skipped for reason.
+func skippedAll(names []string, reason string) {
+	for _, name := range names {
+		if name == "-" {
+			name = "stdin"
+		}
+		skipped(name, reason)
+	}
+}
+
+// unreadable returns the skip reason for a file that couldn't be read
+// because of err, leaving out the file name the error usually repeats.
+func unreadable(err error) string {
+	var pathErr *os.PathError
+	if errors.As(err, &pathErr) {
+		err = pathErr.Err
+	}
+	return "unreadable: " + err.Error()
+}
+
+// A scanResult counts the matches scanFile found.
+type scanResult struct {
+	lines       int // matching lines (or non-matching lines, with -v)
+	occurrences int // non-overlapping occurrences of the pattern in those lines
+	unselected  int // lines that weren't selected
+	bytes       int // length of the selected lines, with their line endings
+}
+
+// fileMatches reports whether the file counts as containing a match,
+// which with -all-lines-match means that every line in it matched.
+func (r scanResult) fileMatches() bool {
+	if *allLinesMatch {
+		return r.unselected == 0
+	}
+	return r.lines > 0
+}
+
+// A runStats sums up the scanResults of every file searched.
+type runStats struct {
+	scanResult
+	filesSearched int
+	filesMatched  int // distinct files with at least one match
+	byExt         map[string]int
+}
+
+func (s *runStats) add(name string, r scanResult) {
+	if *statsByExt && r.occurrences > 0 {
+		if s.byExt == nil {
+			s.byExt = make(map[string]int)
+		}
+		s.byExt[filepath.Ext(name)] += r.occurrences
+	}
+	s.filesSearched++
+	if r.fileMatches() {
+		s.filesMatched++
+	}
+	s.lines += r.lines
+	s.occurrences += r.occurrences
+	s.unselected += r.unselected
+	s.bytes += r.bytes
+}
+
+// print writes the statistics printed by the -stats flag to w.
+func (s *runStats) print(w io.Writer) {
+	fmt.Fprintf(w, "%d files searched\n", s.filesSearched)
+	fmt.Fprintf(w, "%d files contained matches\n", s.filesMatched)
+	fmt.Fprintf(w, "%d matched lines\n", s.lines)
+	fmt.Fprintf(w, "%d matches\n", s.occurrences)
+	if !*statsByExt {
+		return
+	}
+
+	// the extensions with the most matches come first
+	exts := make([]string, 0, len(s.byExt))
+	for ext := range s.byExt {
+		exts = append(exts, ext)
+	}
+	sort.Slice(exts, func(i, j int) bool {
+		if s.byExt[exts[i]] != s.byExt[exts[j]] {
+			return s.byExt[exts[i]] > s.byExt[exts[j]]
+		}
+		return exts[i] < exts[j]
+	})
+	fmt.Fprintf(w, "\nmatches by extension:\n")
+	for _, ext := range exts {
+		label := ext
+		if label == "" {
+			label = "(none)"
+		}
+		fmt.Fprintf(w, "%10d  %s\n", s.byExt[ext], label)
+	}
+}
+
+// printJSON writes the summary printed by the summary-json flag to w, for
+// a search that took elapsed.
+func (s *runStats) printJSON(w io.Writer, elapsed time.Duration) {
+	summary := struct {
+		FilesSearched int   `json:"files_searched"`
+		FilesMatched  int   `json:"files_matched"`
+		MatchedLines  int   `json:"matched_lines"`
+		TotalMatches  int   `json:"total_matches"`
+		BytesScanned  int64 `json:"bytes_scanned"`
+		ElapsedMS     int64 `json:"elapsed_ms"`
+		Errors        int   `json:"errors"`
+	}{
+		s.filesSearched,
+		s.filesMatched,
+		s.lines,
+		s.occurrences,
+		bytesRead,
+		int64(elapsed / time.Millisecond),
+		errorCount,
+	}
+	// encoding a struct of ints can't fail
+	json.NewEncoder(w).Encode(summary)
+}
+
 // scanFile reads the from the specified Reader and checks whether any
 // of the lines match the specified pattern.  It writes any matches to the
-// channel c.  scanFile returns a bool indicating whether a match was found,
-// and an error (if one occurred).
-func scanFile(filename string, rc io.Reader, pattern string, c chan *match) (bool, error) {
+// channel c, using mode to decide whether matches are reported as binary.
+// scanFile returns the number of matches found (it stops early if the rest
+// of the file doesn't matter, or the limit flag has been reached), and an
+// error (if one occurred).
+func scanFile(filename string, rc io.Reader, pattern string, mode binaryMode, c chan *match) (scanResult, error) {
+	// the scanner doubles its buffer whenever a line doesn't fit, so a file
+	// with a few very long lines is still searched in full
+	maxToken := maxLineSize
+	if *scanBufferSize > maxToken {
+		maxToken = *scanBufferSize
+	}
 	scanner := bufio.NewScanner(rc)
-	var matchFound bool = false
-	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
-		// convert to lower case if ignoreCase is enabled
-		// TODO: might be faster to use strings.EqualFold()
-		if *ignoreCase {
-			line = strings.ToLower(line)
-			pattern = strings.ToLower(pattern)
+	scanner.Buffer(make([]byte, *scanBufferSize), maxToken)
+	// offset is the byte offset of the line being scanned, next is the
+	// offset of the line after it (the reader starts after any skipped bytes)
+	var offset, next int64 = 0, *skipBytes
+	grown := false
+	split := scanLines
+	if stringsMode > 0 {
+		// printable runs are text, whatever the rest of the input is
+		split = scanStrings(int(stringsMode))
+		mode = binaryText
+	}
+	scanner.Split(func(data []byte, atEOF bool) (int, []byte, error) {
+		advance, token, err := split(data, atEOF)
+		if token != nil {
+			// with -strings-mode the token needn't start at the beginning
+			// of data, but as it's a slice of data their capacities tell
+			// how far in it does
+			offset = next + int64(cap(data)-cap(token))
+		}
+		next += int64(advance)
+		if *verbose && !grown && advance > *scanBufferSize {
+			grown = true
+			fmt.Fprintf(os.Stderr, "%s: line at offset %d is longer than %d bytes, growing the scan buffer\n", filename, offset, *scanBufferSize)
+		}
+		return advance, token, err
+	})
+	if *ignoreCase && !*wholeLine {
+		pattern = strings.ToLower(pattern)
+	}
+	var result scanResult
+	// printed is the number of lines sent to c, and capped the number of
+	// lines that weren't because of the cap-per-file flag
+	printed, capped := 0, 0
+	// limited is set if the loop ends because the limit flag was reached
+	limited := false
+	for {
+		if remaining == 0 {
+			limited = true
+			break
+		}
+		if !scanner.Scan() {
+			break
+		}
+		original := scanner.Text()
+		line := original
+		if *trimCR {
+			line = strings.TrimSuffix(line, "\r")
+		}
+		// lead is the number of bytes trimmed from the start of the line
+		lead := 0
+		if *trim && !*trimDisplay {
+			trimmed := strings.TrimLeftFunc(line, unicode.IsSpace)
+			lead = len(line) - len(trimmed)
+			line = strings.TrimRightFunc(trimmed, unicode.IsSpace)
+		}
+		// otherwise an empty line is just a line without the pattern in it
+		// (unless the pattern is empty), so -v selects it
+		if *skipEmpty && line == "" {
+			continue
+		}
+		// convert to lower case if ignoreCase is enabled (whole lines are
+		// compared with equalFold instead, which doesn't need a copy)
+		// (unfolded keeps the line as it was, for byte offsets)
+		unfolded := line
+		if *ignoreCase && !*wholeLine {
+			if *asciiOnly {
+				line = lowerASCII(line)
+			} else {
+				line = strings.ToLower(line)
+			}
 		}
 
 		// we either look for a substring or an exact match
 		// (depending on whether the "whole line" flag is enabled)
 		var found bool
-		if *wholeLine {
+		if *wholeLine && *ignoreCase && *asciiOnly {
+			found = equalFoldASCII(line, pattern)
+		} else if *wholeLine && *ignoreCase {
+			found = equalFold(line, pattern)
+		} else if *wholeLine {
 			found = line == pattern
 		} else {
 			found = strings.Contains(line, pattern)
 		}
 
+		// a single line that isn't selected decides -all-lines-match
+		if found == *invert {
+			result.unselected++
+			if *allLinesMatch {
+				break
+			}
+		}
+
 		// we return a match based on the find result and the invert flag
 		if found != *invert {
-			matchFound = true
+			result.lines++
+			result.bytes += int(next - offset)
+			if added := *skipBytes + addedNewline; addedNewline >= 0 && offset <= added && added < next {
+				result.bytes--
+			}
+			if *follow != "" {
+				followLines = result.lines
+			}
+			if remaining > 0 {
+				remaining--
+			}
+			// a line selected by -v has no occurrences of the pattern,
+			// so the line itself counts as one
+			if *wholeLine || *invert || pattern == "" {
+				result.occurrences++
+			} else {
+				result.occurrences += strings.Count(line, pattern)
+			}
+			// when listing file names, the first match is all we need
+			// (unless every line has to match)
+			if *filesWithMatches || *filesWithoutMatch {
+				if *allLinesMatch {
+					continue
+				}
+				break
+			}
+			// likewise for the offset of the first match, which is the start
+			// of the line if we're inverting
+			if *firstMatchOffset {
+				pos := offset
+				if !*invert {
+					// with -x the match is the whole trimmed line
+					i := 0
+					if !*wholeLine {
+						i = strings.Index(line, pattern)
+						if *ignoreCase && !*asciiOnly {
+							i = unfoldedIndex(unfolded, i)
+						}
+					}
+					pos += int64(lead + i)
+				}
+				c <- &match{filename, strconv.FormatInt(pos, 10)}
+				break
+			}
+			// with -c or -total-matches only the counts are wanted
+			if *count || *totalMatches {
+				continue
+			}
+			if *capPerFile > 0 && printed == *capPerFile {
+				capped++
+				continue
+			}
+			if *raw {
+				if m := (&match{filename, original}); firstSeen(m) {
+					c <- m
+					printed++
+				}
+				continue
+			}
 			// if the string isn't valid utf8, we'll consider the file binary
-			binary := !utf8.ValidString(line)
+			// (unless the mode says otherwise)
+			binary := mode == binaryAlways || (mode == binaryAuto && !utf8.ValidString(line))
 			if binary {
 				line = "Binary File Matches"
+			} else if *trimDisplay {
+				line = strings.TrimFunc(line, unicode.IsSpace)
 			}
-			result := &match{
-				filename,
-				line,
+			// every binary file gets its own message, the same as it is
+			if m := (&match{filename, line}); binary || firstSeen(m) {
+				c <- m
+				printed++
 			}
-			c <- result
 
 			// we don't need multiple "binary file matches" messages
 			if binary {
@@ -201,5 +1411,128 @@ func scanFile(filename string, rc io.Reader, pattern string, c chan *match) (boo
 			}
 		}
 	}
-	return matchFound, nil
+	err := scanner.Err()
+	// a followed file always has more to come, and otherwise one more
+	// line tells whether any of the file was left unsearched
+	if limited && err == nil && (*follow != "" || scanner.Scan()) {
+		limitCut = true
+		skipped(filename, "partly searched, -limit reached")
+	}
+	if capped > 0 {
+		c <- &match{filename, fmt.Sprintf("[+%d more]", capped)}
+	}
+	if err == bufio.ErrTooLong {
+		fmt.Fprintf(os.Stderr, "%s: line at offset %d is too long, skipping the rest of the file\n", filename, next)
+		skipped(filename, fmt.Sprintf("partly searched, line at offset %d is too long", next))
+		err = nil
+	}
+	return result, err
+}
+
+// unfoldedIndex maps i, a byte index into strings.ToLower(s), back to the
+// index in s of the same character, since lowercasing can change how many
+// bytes a character takes (İ shrinks from two bytes to one, for one).
+func unfoldedIndex(s string, i int) int {
+	folded := 0
+	for pos, r := range s {
+		if folded >= i {
+			return pos
+		}
+		// like strings.ToLower, an invalid byte becomes utf8.RuneError
+		folded += utf8.RuneLen(unicode.ToLower(r))
+	}
+	return len(s)
+}
+
+// isASCII reports whether s contains only ASCII characters.
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// lowerASCII is like strings.ToLower, but only changes ASCII letters,
+// leaving every other byte as it is.
+func lowerASCII(s string) string {
+	i := 0
+	for i < len(s) && !('A' <= s[i] && s[i] <= 'Z') {
+		i++
+	}
+	if i == len(s) {
+		return s
+	}
+	b := []byte(s)
+	for ; i < len(b); i++ {
+		if 'A' <= b[i] && b[i] <= 'Z' {
+			b[i] += 'a' - 'A'
+		}
+	}
+	return string(b)
+}
+
+// equalFoldASCII reports whether s and t are equal when the case of ASCII
+// letters is ignored, leaving every other byte to be compared as it is.
+func equalFoldASCII(s, t string) bool {
+	if len(s) != len(t) {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		a, b := s[i], t[i]
+		if 'A' <= a && a <= 'Z' {
+			a += 'a' - 'A'
+		}
+		if 'A' <= b && b <= 'Z' {
+			b += 'a' - 'A'
+		}
+		if a != b {
+			return false
+		}
+	}
+	return true
+}
+
+// equalFold reports whether s and t are equal under Unicode case-folding,
+// like strings.EqualFold, but compares ASCII bytes directly, only falling
+// back to strings.EqualFold from the first non-ASCII byte.
+func equalFold(s, t string) bool {
+	for i := 0; i < len(s) && i < len(t); i++ {
+		a, b := s[i], t[i]
+		if a >= utf8.RuneSelf || b >= utf8.RuneSelf {
+			return strings.EqualFold(s[i:], t[i:])
+		}
+		if a == b {
+			continue
+		}
+		if 'A' <= a && a <= 'Z' {
+			a += 'a' - 'A'
+		}
+		if 'A' <= b && b <= 'Z' {
+			b += 'a' - 'A'
+		}
+		if a != b {
+			return false
+		}
+	}
+	return len(s) == len(t)
+}
+
+// scanLines is a split function for a bufio.Scanner that returns each line
+// of text, stripped of its trailing newline.  Unlike bufio.ScanLines it keeps
+// a carriage return before the newline, which is left to the trim flags.
+func scanLines(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	if atEOF && len(data) == 0 {
+		return 0, nil, nil
+	}
+	if i := bytes.IndexByte(data, '\n'); i >= 0 {
+		return i + 1, data[:i], nil
+	}
+	// if we're at EOF, we have a final, non-terminated line
+	if atEOF {
+		return len(data), data, nil
+	}
+	// request more data
+	return 0, nil, nil
 }
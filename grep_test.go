@@ -0,0 +1,1562 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The tests run the test binary itself as grep when GREP_TEST_MAIN is set,
+// so that runGrep can check what a whole run prints and exits with.
+func TestMain(m *testing.M) {
+	if os.Getenv("GREP_TEST_MAIN") == "1" {
+		main()
+		return
+	}
+	os.Exit(m.Run())
+}
+
+// runGrep runs grep with args in dir, with stdin as its input, and returns
+// what it wrote to stdout and stderr and its exit status.
+func runGrep(t testing.TB, dir, stdin string, args ...string) (string, string, int) {
+	t.Helper()
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(exe, args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "GREP_TEST_MAIN=1")
+	cmd.Stdin = strings.NewReader(stdin)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	status := 0
+	if err := cmd.Run(); err != nil {
+		exitErr, ok := err.(*exec.ExitError)
+		if !ok {
+			t.Fatal(err)
+		}
+		status = exitErr.ExitCode()
+	}
+	return stdout.String(), stderr.String(), status
+}
+
+// writeFiles creates a file under dir for each name in files, holding its
+// contents, along with any directories it needs.
+func writeFiles(t testing.TB, dir string, files map[string]string) {
+	t.Helper()
+	for name, contents := range files {
+		name = filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(name), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(name, []byte(contents), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// setFlags sets each flag named in nameValues (alternating names and
+// values) for the rest of the test, and resets the state a search builds
+// up, both now and once the test is over.
+func setFlags(t testing.TB, nameValues ...string) {
+	t.Helper()
+	reset := func() {
+		flag.VisitAll(func(f *flag.Flag) {
+			if _, ok := f.Value.(ruleFlag); !ok && f.Name != "strings-mode" && !strings.HasPrefix(f.Name, "test.") {
+				f.Value.Set(f.DefValue)
+			}
+		})
+		stringsMode = 0
+		rules = nil
+		filenameRegexp = nil
+		modifiedSince = time.Time{}
+		remaining = -1
+		limitCut = false
+		bytesRead = 0
+		errorCount = 0
+		skips = nil
+		depths = make(map[string]int)
+		stdinOnly = false
+		searchRoots = nil
+		fileRoots = make(map[string]string)
+		seenLines = make(map[string]*dedupeEntry)
+		seenOrder = nil
+		followLines = 0
+		addedNewline = -1
+	}
+	reset()
+	t.Cleanup(reset)
+	for i := 0; i+1 < len(nameValues); i += 2 {
+		if err := flag.Set(nameValues[i], nameValues[i+1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// scan runs scanFile over input looking for pattern, and returns its
+// result and the lines it sent.
+func scan(t *testing.T, input, pattern string) (scanResult, []string) {
+	t.Helper()
+	result, lines, err := scanReader(strings.NewReader(input), pattern, binaryAuto)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return result, lines
+}
+
+// scanReader is like scan, but reads from r with the given mode and
+// returns scanFile's error.
+func scanReader(r io.Reader, pattern string, mode binaryMode) (scanResult, []string, error) {
+	c := make(chan *match)
+	done := make(chan []string)
+	go func() {
+		var lines []string
+		for m := range c {
+			lines = append(lines, m.line)
+		}
+		done <- lines
+	}()
+	result, err := scanFile("test", r, pattern, mode, c)
+	close(c)
+	return result, <-done, err
+}
+
+func TestStdinBinary(t *testing.T) {
+	tests := []struct {
+		mode  string
+		input string
+		want  string
+	}{
+		{"auto", "text\nmatch\n", "stdin: match\n"},
+		{"auto", "te\x00xt\nmatch\n", "stdin: Binary File Matches\n"},
+		{"text", "te\x00xt\nmatch\n", "stdin: match\n"},
+		{"binary", "text\nmatch\n", "stdin: Binary File Matches\n"},
+	}
+	for _, test := range tests {
+		stdout, _, status := runGrep(t, "", test.input, "-stdin-binary", test.mode, "match")
+		if stdout != test.want || status != exitMatchesFound {
+			t.Errorf("-stdin-binary %s on %q printed %q and exited with %d, want %q and 0", test.mode, test.input, stdout, status, test.want)
+		}
+	}
+}
+
+func TestListingExitStatus(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"tree/a.txt":     "foo\n",
+		"tree/c.txt":     "bar\n",
+		"tree/sub/b.txt": "bar\nfoo\n",
+	})
+	tests := []struct {
+		args   []string
+		want   string
+		status int
+	}{
+		{[]string{"-r", "-l", "foo", "tree"}, "tree/a.txt\ntree/sub/b.txt\n", exitMatchesFound},
+		{[]string{"-r", "-l", "baz", "tree"}, "", exitNoMatches},
+		{[]string{"-r", "-L", "foo", "tree"}, "tree/c.txt\n", exitMatchesFound},
+		{[]string{"-L", "foo", "tree/a.txt"}, "", exitNoMatches},
+		{[]string{"-l", "foo", "tree/a.txt", "missing.txt"}, "tree/a.txt\n", exitError},
+		{[]string{"-exit-count", "-l", "foo", "tree/a.txt", "missing.txt"}, "tree/a.txt\n", exitCountError},
+	}
+	for _, test := range tests {
+		stdout, _, status := runGrep(t, dir, "", test.args...)
+		if stdout != test.want || status != test.status {
+			t.Errorf("grep %s printed %q and exited with %d, want %q and %d", strings.Join(test.args, " "), stdout, status, test.want, test.status)
+		}
+	}
+}
+
+func TestUnreadableInput(t *testing.T) {
+	// /proc/self/mem can be opened, but reading from its start fails
+	if _, err := os.Stat("/proc/self/mem"); err != nil {
+		t.Skip("no /proc/self/mem to read")
+	}
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"a.txt": "foo\n",
+	})
+	stdout, stderr, status := runGrep(t, dir, "", "foo", "/proc/self/mem", "a.txt")
+	if want := "a.txt: foo\n"; stdout != want || !strings.HasPrefix(stderr, "read /proc/self/mem: ") || status != exitError {
+		t.Errorf("grep foo /proc/self/mem a.txt printed %q and %q and exited with %d, want %q, the read error and %d", stdout, stderr, status, want, exitError)
+	}
+}
+
+func TestMaxDepth(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"top.txt":             "",
+		"sub/deep.txt":        "",
+		"sub/sub2/deeper.txt": "",
+	})
+	top := filepath.Join(dir, "top.txt")
+	deep := filepath.Join(dir, "sub/deep.txt")
+	deeper := filepath.Join(dir, "sub/sub2/deeper.txt")
+	tests := []struct {
+		depth string
+		want  []string
+	}{
+		{"-1", []string{deep, deeper, top}},
+		{"0", nil},
+		{"1", []string{top}},
+		{"2", []string{deep, top}},
+		{"3", []string{deep, deeper, top}},
+	}
+	for _, test := range tests {
+		setFlags(t, "r", "true", "max-depth", test.depth)
+		if got := inputFiles([]string{dir}); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("-max-depth %s found %q, want %q", test.depth, got, test.want)
+		}
+	}
+}
+
+func TestTrimCR(t *testing.T) {
+	tests := []struct {
+		trimCR string
+		lines  int
+	}{
+		{"false", 0},
+		{"true", 1},
+	}
+	for _, test := range tests {
+		setFlags(t, "trim", "false", "x", "true", "trim-cr", test.trimCR)
+		result, _ := scan(t, "abc\r\n abc\r\n", "abc")
+		if result.lines != test.lines {
+			t.Errorf("-x -trim-cr=%s selected %d lines, want %d", test.trimCR, result.lines, test.lines)
+		}
+		// the carriage return is still part of the line
+		if test.lines == 1 && result.bytes != 5 {
+			t.Errorf("-x -trim-cr=%s counted %d bytes, want 5", test.trimCR, result.bytes)
+		}
+	}
+}
+
+func TestDereferenceRecursive(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"tree/real/a.txt": "",
+		"outside/b.txt":   "",
+	})
+	if err := os.Symlink(filepath.Join(dir, "outside"), filepath.Join(dir, "tree/link")); err != nil {
+		t.Skip("can't create symbolic links:", err)
+	}
+	tree := filepath.Join(dir, "tree")
+	tests := []struct {
+		flag string
+		want []string
+	}{
+		{"r", []string{tree + "/real/a.txt"}},
+		{"R", []string{tree + "/link/b.txt", tree + "/real/a.txt"}},
+		{"dereference-recursive", []string{tree + "/link/b.txt", tree + "/real/a.txt"}},
+	}
+	for _, test := range tests {
+		setFlags(t, test.flag, "true")
+		if got := inputFiles([]string{tree}); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("-%s found %q, want %q", test.flag, got, test.want)
+		}
+	}
+}
+
+func TestFirstMatchOffset(t *testing.T) {
+	tests := []struct {
+		flags []string
+		input string
+		want  []string
+	}{
+		{nil, "abc\nxyz foo foo\nfoo\n", []string{"8"}},
+		{nil, "abc\n", nil},
+		// trimmed whitespace still counts
+		{nil, "abc\n  foo\n", []string{"6"}},
+		// İ is two bytes, but lowercases to the single byte i
+		{[]string{"i", "true"}, "İxFOO\n", []string{"3"}},
+		{[]string{"i", "true", "ascii-only", "true"}, "İxFOO\n", []string{"3"}},
+		{[]string{"v", "true"}, "foo\nabc\n", []string{"4"}},
+		// with -x the match starts after the trimmed whitespace too
+		{[]string{"x", "true"}, "foo bar\n foo\n", []string{"9"}},
+		{[]string{"x", "true"}, "abc\n  foo\n", []string{"6"}},
+	}
+	for _, test := range tests {
+		setFlags(t, append([]string{"first-match-offset", "true"}, test.flags...)...)
+		if _, got := scan(t, test.input, "foo"); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("-first-match-offset %s on %q gave %q, want %q", strings.Join(test.flags, "="), test.input, got, test.want)
+		}
+	}
+
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"a.txt": "abc\nfoo\nfoo\n",
+		"b.txt": "abc\n",
+		"c.txt": "foo\n",
+	})
+	stdout, _, _ := runGrep(t, dir, "", "-first-match-offset", "foo", "a.txt", "b.txt", "c.txt")
+	if want := "a.txt: 4\nc.txt: 0\n"; stdout != want {
+		t.Errorf("-first-match-offset printed %q, want %q", stdout, want)
+	}
+}
+
+func TestNewerThan(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"old.txt":    "",
+		"recent.txt": "",
+	})
+	now := time.Now()
+	old := filepath.Join(dir, "old.txt")
+	recent := filepath.Join(dir, "recent.txt")
+	if err := os.Chtimes(old, now.Add(-48*time.Hour), now.Add(-48*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		value string
+		want  []string
+	}{
+		{"", []string{old, recent}},
+		{"24h", []string{recent}},
+		{"72h", []string{old, recent}},
+		{now.Add(-24 * time.Hour).Format(time.RFC3339), []string{recent}},
+		{now.Add(-72 * time.Hour).Format(time.RFC3339), []string{old, recent}},
+	}
+	for _, test := range tests {
+		setFlags(t, "r", "true")
+		if test.value != "" {
+			since, err := parseSince(test.value, now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			modifiedSince = since
+		}
+		if got := inputFiles([]string{dir}); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("-newer-than %q found %q, want %q", test.value, got, test.want)
+		}
+	}
+	if _, err := parseSince("yesterday", now); err == nil {
+		t.Error("parseSince accepted \"yesterday\"")
+	}
+}
+
+func TestNoTrailingNewline(t *testing.T) {
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"foo"}, "stdin: foo\nstdin: foo2\n"},
+		{[]string{"-no-trailing-newline", "foo"}, "stdin: foo\nstdin: foo2"},
+		{[]string{"-no-trailing-newline", "baz"}, ""},
+	}
+	for _, test := range tests {
+		if stdout, _, _ := runGrep(t, "", "foo\nbar\nfoo2\n", test.args...); stdout != test.want {
+			t.Errorf("grep %s printed %q, want %q", strings.Join(test.args, " "), stdout, test.want)
+		}
+	}
+}
+
+func TestTotalMatches(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"a.txt": "foo foo\nfoo\nbar\n",
+		"b.txt": "bar\n",
+		"c.txt": "foofoo foo\n",
+	})
+	tests := []struct {
+		args   []string
+		want   string
+		status int
+	}{
+		{[]string{"-total-matches", "foo", "a.txt", "b.txt", "c.txt"}, "6\n", exitMatchesFound},
+		// a line selected by -v counts once
+		{[]string{"-total-matches", "-v", "foo", "a.txt", "b.txt", "c.txt"}, "2\n", exitMatchesFound},
+		{[]string{"-total-matches", "baz", "a.txt", "b.txt", "c.txt"}, "0\n", exitNoMatches},
+		{[]string{"-total-matches", "-l", "foo", "a.txt"}, "", exitError},
+		{[]string{"-total-matches", "-first-match-offset", "foo", "a.txt"}, "", exitError},
+		{[]string{"-total-matches", "-files", "a.txt"}, "", exitError},
+	}
+	for _, test := range tests {
+		stdout, _, status := runGrep(t, dir, "", test.args...)
+		if stdout != test.want || status != test.status {
+			t.Errorf("grep %s printed %q and exited with %d, want %q and %d", strings.Join(test.args, " "), stdout, status, test.want, test.status)
+		}
+	}
+}
+
+func TestRaw(t *testing.T) {
+	tests := []string{
+		"  \tfoo bar  \r",
+		"\xff foo",
+		"foo\x00",
+	}
+	for _, line := range tests {
+		setFlags(t, "raw", "true")
+		if _, got := scan(t, "abc\n"+line+"\n", "foo"); !reflect.DeepEqual(got, []string{line}) {
+			t.Errorf("-raw sent %q, want %q", got, []string{line})
+		}
+		if stdout, _, _ := runGrep(t, "", line+"\n", "-raw", "foo"); stdout != line+"\n" {
+			t.Errorf("-raw printed %q, want %q", stdout, line+"\n")
+		}
+	}
+}
+
+func TestPatternPrefixSuffix(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"main.go": "func main() {\n\tmain()\n\tmainLoop()\n}\n",
+	})
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"main", "main.go"}, "main.go: func main() {\nmain.go: main()\nmain.go: mainLoop()\n"},
+		{[]string{"-pattern-prefix", "func ", "main", "main.go"}, "main.go: func main() {\n"},
+		{[]string{"-pattern-suffix", "(", "main", "main.go"}, "main.go: func main() {\nmain.go: main()\n"},
+		{[]string{"-pattern-prefix", "func ", "-pattern-suffix", "(", "main", "main.go"}, "main.go: func main() {\n"},
+		{[]string{"-x", "-pattern-suffix", "()", "main", "main.go"}, "main.go: main()\n"},
+	}
+	for _, test := range tests {
+		if stdout, _, _ := runGrep(t, dir, "", test.args...); stdout != test.want {
+			t.Errorf("grep %s printed %q, want %q", strings.Join(test.args, " "), stdout, test.want)
+		}
+	}
+}
+
+// BenchmarkOutputBufferSize times printing 200,000 matching lines to a
+// pipe with output buffers of a few sizes.
+func BenchmarkOutputBufferSize(b *testing.B) {
+	dir := b.TempDir()
+	writeFiles(b, dir, map[string]string{
+		"big.txt": strings.Repeat("a matching line\n", 200000),
+	})
+	for _, size := range []int{1, 4096, 64 * 1024} {
+		b.Run(strconv.Itoa(size), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				runGrep(b, dir, "", "-output-buffer-size", strconv.Itoa(size), "matching", "big.txt")
+			}
+		})
+	}
+}
+
+func TestScanBufferSize(t *testing.T) {
+	long := strings.Repeat("x", 100*1024) + "foo"
+	tests := []struct {
+		size  string
+		input string
+	}{
+		// bigger than the default size
+		{"", long},
+		{"16", long},
+		{"16", "abc\n" + strings.Repeat("y", 1000) + "foo\nfoo"},
+		{"1048576", long},
+	}
+	for _, test := range tests {
+		if test.size != "" {
+			setFlags(t, "scan-buffer-size", test.size)
+		} else {
+			setFlags(t)
+		}
+		result, _ := scan(t, test.input, "foo")
+		if want := strings.Count(test.input, "foo"); result.lines != want {
+			t.Errorf("-scan-buffer-size %s selected %d lines, want %d", test.size, result.lines, want)
+		}
+	}
+}
+
+// BenchmarkScanBufferSize times searching 10MB of short lines with scan
+// buffers of a few sizes.
+func BenchmarkScanBufferSize(b *testing.B) {
+	input := []byte(strings.Repeat("a line that doesn't match\n", 400000))
+	for _, size := range []int{4096, 64 * 1024, 1 << 20} {
+		b.Run(strconv.Itoa(size), func(b *testing.B) {
+			setFlags(b, "scan-buffer-size", strconv.Itoa(size))
+			b.SetBytes(int64(len(input)))
+			for i := 0; i < b.N; i++ {
+				scanReader(bytes.NewReader(input), "foo", binaryAuto)
+			}
+		})
+	}
+}
+
+func TestStatsFilesMatched(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"a.txt": "foo\nfoo foo\n",
+		"b.txt": "foo\n",
+		"c.txt": "bar\n",
+	})
+	_, stderr, _ := runGrep(t, dir, "", "-stats", "foo", "a.txt", "b.txt", "c.txt")
+	want := "3 files searched\n2 files contained matches\n3 matched lines\n4 matches\n"
+	if stderr != want {
+		t.Errorf("-stats printed %q, want %q", stderr, want)
+	}
+}
+
+func TestSkipBytes(t *testing.T) {
+	dir := t.TempDir()
+	header := "HEAD\x00\x01\x02\n"
+	writeFiles(t, dir, map[string]string{
+		"h.bin": header + "abc\nfoo\n",
+	})
+	tests := []struct {
+		args  []string
+		stdin string
+		want  string
+	}{
+		{[]string{"foo", "h.bin"}, "", "h.bin: Binary File Matches\n"},
+		{[]string{"-skip-bytes", "8", "foo", "h.bin"}, "", "h.bin: foo\n"},
+		{[]string{"-skip-bytes", "8", "-first-match-offset", "foo", "h.bin"}, "", "h.bin: 12\n"},
+		{[]string{"-skip-bytes", "8", "-first-match-offset", "foo"}, header + "abc\nfoo\n", "stdin: 12\n"},
+		{[]string{"-skip-bytes", "100", "foo", "h.bin"}, "", ""},
+	}
+	for _, test := range tests {
+		if stdout, _, _ := runGrep(t, dir, test.stdin, test.args...); stdout != test.want {
+			t.Errorf("grep %s printed %q, want %q", strings.Join(test.args, " "), stdout, test.want)
+		}
+	}
+}
+
+func TestAllLinesMatch(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"good.txt": "foo\nfoo bar\n",
+		"bad.txt":  "foo\nbar\nfoo\n",
+	})
+	tests := []struct {
+		args   []string
+		want   string
+		status int
+	}{
+		{[]string{"-l", "foo", "good.txt", "bad.txt"}, "good.txt\nbad.txt\n", exitMatchesFound},
+		{[]string{"-l", "-all-lines-match", "foo", "good.txt", "bad.txt"}, "good.txt\n", exitMatchesFound},
+		{[]string{"-L", "-all-lines-match", "foo", "good.txt", "bad.txt"}, "bad.txt\n", exitMatchesFound},
+		{[]string{"-l", "-all-lines-match", "foo", "bad.txt"}, "", exitNoMatches},
+		{[]string{"-all-lines-match", "foo", "good.txt"}, "", exitError},
+	}
+	for _, test := range tests {
+		stdout, _, status := runGrep(t, dir, "", test.args...)
+		if stdout != test.want || status != test.status {
+			t.Errorf("grep %s printed %q and exited with %d, want %q and %d", strings.Join(test.args, " "), stdout, status, test.want, test.status)
+		}
+	}
+}
+
+func TestFailOnMatch(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"a.txt": "ok\nTODO fix\n",
+	})
+	tests := []struct {
+		args   []string
+		want   string
+		status int
+	}{
+		{[]string{"-fail-on-match", "TODO", "a.txt"}, "a.txt: TODO fix\n", exitNoMatches},
+		{[]string{"-fail-on-match", "FIXME", "a.txt"}, "", exitMatchesFound},
+		{[]string{"-fail-on-match", "TODO", "missing.txt"}, "", exitError},
+		{[]string{"-fail-on-match", "-exit-count", "TODO", "a.txt"}, "", exitError},
+	}
+	for _, test := range tests {
+		stdout, _, status := runGrep(t, dir, "", test.args...)
+		if stdout != test.want || status != test.status {
+			t.Errorf("grep %s printed %q and exited with %d, want %q and %d", strings.Join(test.args, " "), stdout, status, test.want, test.status)
+		}
+	}
+}
+
+func TestStdinAmongFiles(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"a.txt": "foo a\n",
+		"b.txt": "foo b\n",
+	})
+	stdout, _, status := runGrep(t, dir, "foo stdin\n", "foo", "a.txt", "-", "b.txt")
+	if want := "a.txt: foo a\nstdin: foo stdin\nb.txt: foo b\n"; stdout != want || status != exitMatchesFound {
+		t.Errorf("grep foo a.txt - b.txt printed %q and exited with %d, want %q and 0", stdout, status, want)
+	}
+	stdout, stderr, status := runGrep(t, dir, "foo stdin\n", "foo", "-", "a.txt", "-")
+	if stdout != "" || status != exitError || !strings.Contains(stderr, "only be given once") {
+		t.Errorf("grep foo - a.txt - printed %q and %q and exited with %d, want an error", stdout, stderr, status)
+	}
+}
+
+func TestDisplayName(t *testing.T) {
+	tests := []struct {
+		flags []string
+		file  string
+		want  string
+	}{
+		{nil, "./src/a.go", "./src/a.go"},
+		{[]string{"strip-prefix", "./src/"}, "./src/a.go", "a.go"},
+		{[]string{"strip-prefix", "./src/"}, "./lib/a.go", "./lib/a.go"},
+		{[]string{"filename-template", "https://example.com/{path}"}, "src/a.go", "https://example.com/src/a.go"},
+		{[]string{"strip-prefix", "./", "filename-template", "<{path}>"}, "./a.go", "<a.go>"},
+	}
+	for _, test := range tests {
+		setFlags(t, test.flags...)
+		if got := displayName(test.file); got != test.want {
+			t.Errorf("%q displayed %s as %q, want %q", test.flags, test.file, got, test.want)
+		}
+		if got := (&match{test.file, "foo"}).String(); got != test.want+": foo" {
+			t.Errorf("%q printed a match in %s as %q, want %q", test.flags, test.file, got, test.want+": foo")
+		}
+	}
+}
+
+func TestStatsByExt(t *testing.T) {
+	setFlags(t, "stats-by-ext", "true")
+	var stats runStats
+	stats.add("a.go", scanResult{lines: 2, occurrences: 3})
+	stats.add("b.go", scanResult{lines: 1, occurrences: 1})
+	stats.add("c.md", scanResult{lines: 2, occurrences: 2})
+	stats.add("Makefile", scanResult{lines: 1, occurrences: 2})
+	stats.add("d.txt", scanResult{})
+	var out bytes.Buffer
+	stats.print(&out)
+	want := `5 files searched
+4 files contained matches
+6 matched lines
+8 matches
+
+matches by extension:
+         4  .go
+         2  (none)
+         2  .md
+`
+	if out.String() != want {
+		t.Errorf("-stats-by-ext printed\n%s\nwant\n%s", out.String(), want)
+	}
+}
+
+func TestLongLineGrowsBuffer(t *testing.T) {
+	dir := t.TempDir()
+	long := strings.Repeat("x", 10000) + " foo"
+	writeFiles(t, dir, map[string]string{
+		"long.txt": "abc\n" + long + "\nfoo\n",
+	})
+	stdout, stderr, status := runGrep(t, dir, "", "-verbose", "-scan-buffer-size", "64", "foo", "long.txt")
+	if want := "long.txt: " + long + "\nlong.txt: foo\n"; stdout != want || status != exitMatchesFound {
+		t.Errorf("grep printed %d bytes and exited with %d, want %d bytes and 0", len(stdout), status, len(want))
+	}
+	if want := "long.txt: line at offset 4 is longer than 64 bytes, growing the scan buffer\n"; stderr != want {
+		t.Errorf("grep -verbose printed %q, want %q", stderr, want)
+	}
+}
+
+func TestCountInvert(t *testing.T) {
+	tests := []struct {
+		input string
+		want  int
+	}{
+		{"", 0},
+		{"foo\n", 0},
+		{"foo\nafoo\nfoob", 0},
+		{"a\nb\nc\n", 3},
+		{"a\nb\nc", 3},
+		{"a\nfoo\nb", 2},
+		// an empty line doesn't contain the pattern
+		{"\n\nfoo\n", 2},
+	}
+	for _, test := range tests {
+		setFlags(t, "c", "true", "v", "true")
+		if result, _ := scan(t, test.input, "foo"); result.lines != test.want {
+			t.Errorf("-c -v counted %d lines in %q, want %d", result.lines, test.input, test.want)
+		}
+	}
+
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"empty.txt": "",
+		"all.txt":   "foo\nfoo",
+		"none.txt":  "a\nb",
+	})
+	stdout, _, _ := runGrep(t, dir, "", "-c", "-v", "foo", "empty.txt", "all.txt", "none.txt")
+	if want := "empty.txt: 0\nall.txt: 0\nnone.txt: 2\n"; stdout != want {
+		t.Errorf("grep -c -v printed %q, want %q", stdout, want)
+	}
+}
+
+func TestListingCountExitStatus(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"a.txt": "foo\n",
+	})
+	for _, flag := range []string{"-c", "-bytes"} {
+		stdout, _, status := runGrep(t, dir, "", "-files", flag, "a.txt")
+		if want := "a.txt\n"; stdout != want || status != exitMatchesFound {
+			t.Errorf("grep -files %s printed %q and exited with %d, want %q and 0", flag, stdout, status, want)
+		}
+	}
+}
+
+func TestTee(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"a.txt": "foo\nbar\nfoo bar\n",
+	})
+	stdout, _, status := runGrep(t, dir, "", "-tee", "out.txt", "foo", "a.txt")
+	saved, err := ioutil.ReadFile(filepath.Join(dir, "out.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "a.txt: foo\na.txt: foo bar\n"; stdout != want || string(saved) != want || status != exitMatchesFound {
+		t.Errorf("-tee printed %q and saved %q, and exited with %d, want %q in both and 0", stdout, saved, status, want)
+	}
+	if _, _, status := runGrep(t, dir, "", "-tee", "missing/out.txt", "foo", "a.txt"); status != exitError {
+		t.Errorf("-tee to a missing directory exited with %d, want %d", status, exitError)
+	}
+
+	// out.txt now exists, so searching the directory again would read it
+	errors := []struct {
+		args []string
+		err  string
+	}{
+		{[]string{"-tee", "out.txt", "foo", "a.txt", "out.txt"}, "would overwrite the input out.txt"},
+		{[]string{"-r", "-tee", "out.txt", "foo", "."}, "would overwrite the input out.txt"},
+		{[]string{"-tee", "./out.txt", "-follow-file", "out.txt", "foo"}, "would overwrite the input out.txt"},
+	}
+	for _, test := range errors {
+		_, stderr, status := runGrep(t, dir, "", test.args...)
+		if !strings.Contains(stderr, test.err) || status != exitError {
+			t.Errorf("grep %s printed %q and exited with %d, want an error containing %q", strings.Join(test.args, " "), stderr, status, test.err)
+		}
+	}
+	if saved, _ := ioutil.ReadFile(filepath.Join(dir, "out.txt")); string(saved) != "a.txt: foo\na.txt: foo bar\n" {
+		t.Errorf("-tee onto an input left it holding %q", saved)
+	}
+}
+
+func TestLimit(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"a.txt": "foo1\nfoo2\nfoo3\n",
+		"b.txt": "foo4\n",
+		"c.txt": "foo5\n",
+	})
+	tests := []struct {
+		limit  string
+		lines  int
+		stderr string
+	}{
+		{"1", 1, "Stopped after 1 selected lines, leaving 2 files unsearched\n" +
+			"3 files skipped:\n  a.txt: partly searched, -limit reached\n  b.txt: not searched, -limit reached\n  c.txt: not searched, -limit reached\n"},
+		// a.txt was searched to the end
+		{"3", 3, "Stopped after 3 selected lines, leaving 2 files unsearched\n" +
+			"2 files skipped:\n  b.txt: not searched, -limit reached\n  c.txt: not searched, -limit reached\n"},
+		// the limit was reached with nothing left to search
+		{"5", 5, ""},
+		{"6", 5, ""},
+	}
+	for _, test := range tests {
+		stdout, stderr, _ := runGrep(t, dir, "", "-report-skipped", "-limit", test.limit, "foo", "a.txt", "b.txt", "c.txt")
+		if lines := strings.Count(stdout, "\n"); lines != test.lines || stderr != test.stderr {
+			t.Errorf("-limit %s printed %d lines and %q, want %d lines and %q", test.limit, lines, stderr, test.lines, test.stderr)
+		}
+	}
+}
+
+func TestEqualFold(t *testing.T) {
+	tests := []struct {
+		s, t string
+		want bool
+	}{
+		{"", "", true},
+		{"abc", "abc", true},
+		{"aBc", "AbC", true},
+		{"abc", "abd", false},
+		{"abc", "ab", false},
+		{"ab", "abc", false},
+		{"a-b", "A-B", true},
+		{"[", "{", false},
+		{"ÀbÇ", "àBç", true},
+		{"xÀ", "xà", true},
+		{"σ", "Σ", true},
+		{"ς", "Σ", true},
+		// the Kelvin sign folds to k
+		{"K", "k", true},
+		{"Straße", "STRASSE", false},
+		{"a\xffb", "A\xffB", true},
+	}
+	for _, test := range tests {
+		if got := equalFold(test.s, test.t); got != test.want {
+			t.Errorf("equalFold(%q, %q) = %v, want %v", test.s, test.t, got, test.want)
+		}
+		if got := strings.EqualFold(test.s, test.t); got != test.want {
+			t.Errorf("strings.EqualFold(%q, %q) = %v, the test is wrong", test.s, test.t, got)
+		}
+	}
+}
+
+func TestWholeLineIgnoreCase(t *testing.T) {
+	setFlags(t, "x", "true", "i", "true")
+	result, lines := scan(t, "ÜNÏCODE line\nünïcode LINE\nünïcode line2\nunicode line\n", "Ünïcode Line")
+	if want := []string{"ÜNÏCODE line", "ünïcode LINE"}; result.lines != 2 || !reflect.DeepEqual(lines, want) {
+		t.Errorf("-x -i selected %q, want %q", lines, want)
+	}
+}
+
+// BenchmarkWholeLineIgnoreCase times -x -i over 100,000 lines, a tenth of
+// which match.
+func BenchmarkWholeLineIgnoreCase(b *testing.B) {
+	var input strings.Builder
+	for i := 0; i < 100000; i++ {
+		if i%10 == 0 {
+			input.WriteString("Some Matching LINE\n")
+		} else {
+			input.WriteString("some other line of text\n")
+		}
+	}
+	tests := []struct {
+		name    string
+		flags   []string
+		pattern string
+	}{
+		{"ascii", nil, "some matching line"},
+		{"ascii-only", []string{"ascii-only", "true"}, "some matching line"},
+		{"unicode", nil, "söme matching line"},
+	}
+	for _, test := range tests {
+		b.Run(test.name, func(b *testing.B) {
+			setFlags(b, append([]string{"x", "true", "i", "true"}, test.flags...)...)
+			b.SetBytes(int64(input.Len()))
+			for i := 0; i < b.N; i++ {
+				scanReader(strings.NewReader(input.String()), test.pattern, binaryAuto)
+			}
+		})
+	}
+}
+
+func TestNoMatchMessage(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"a.txt": "foo\n",
+	})
+	tests := []struct {
+		args   []string
+		stderr string
+	}{
+		{[]string{"-no-match-message", "nothing found", "bar", "a.txt"}, "nothing found\n"},
+		{[]string{"-no-match-message", "nothing found", "foo", "a.txt"}, ""},
+		{[]string{"bar", "a.txt"}, ""},
+	}
+	for _, test := range tests {
+		if _, stderr, _ := runGrep(t, dir, "", test.args...); stderr != test.stderr {
+			t.Errorf("grep %s printed %q to stderr, want %q", strings.Join(test.args, " "), stderr, test.stderr)
+		}
+	}
+}
+
+// A slowReader returns a line each time it's read, after a delay.
+type slowReader struct {
+	lines int
+	delay time.Duration
+}
+
+func (r *slowReader) Read(p []byte) (int, error) {
+	if r.lines == 0 {
+		return 0, io.EOF
+	}
+	time.Sleep(r.delay)
+	r.lines--
+	return copy(p, "foo\n"), nil
+}
+
+func TestPerFileTimeout(t *testing.T) {
+	setFlags(t, "per-file-timeout", "50ms")
+	result, _, err := scanReader(withTimeout(&slowReader{100, 5 * time.Millisecond}), "foo", binaryAuto)
+	if err != errTimeout || result.lines == 0 || result.lines == 100 {
+		t.Errorf("a slow file gave %v after %d lines, want %v part way through", err, result.lines, errTimeout)
+	}
+	// the next file gets a timeout of its own
+	result, _, err = scanReader(withTimeout(&slowReader{2, 5 * time.Millisecond}), "foo", binaryAuto)
+	if err != nil || result.lines != 2 {
+		t.Errorf("a file after a slow one gave %v after %d lines, want 2 lines", err, result.lines)
+	}
+
+	setFlags(t)
+	r := strings.NewReader("foo\n")
+	if withTimeout(r) != io.Reader(r) {
+		t.Error("withTimeout wrapped a reader without -per-file-timeout")
+	}
+}
+
+func TestHyperlink(t *testing.T) {
+	abs, err := filepath.Abs("src/a.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		flags []string
+		file  string
+		want  string
+	}{
+		{nil, "src/a.go", "src/a.go"},
+		{[]string{"hyperlink", "true"}, "src/a.go", "\x1b]8;;file://" + abs + "\x1b\\src/a.go\x1b]8;;\x1b\\"},
+		{[]string{"hyperlink", "true", "hyperlink-format", "editor://open?file={path}"}, "src/a.go", "\x1b]8;;editor://open?file=" + abs + "\x1b\\src/a.go\x1b]8;;\x1b\\"},
+		{[]string{"hyperlink", "true", "strip-prefix", "src/"}, "src/a.go", "\x1b]8;;file://" + abs + "\x1b\\a.go\x1b]8;;\x1b\\"},
+		// the path is escaped, so the # doesn't start a fragment
+		{[]string{"hyperlink", "true"}, "src/a b#1%.txt", "\x1b]8;;file://" + filepath.Dir(abs) + "/a%20b%231%25.txt\x1b\\src/a b#1%.txt\x1b]8;;\x1b\\"},
+		// but a custom format gets the path as it is
+		{[]string{"hyperlink", "true", "hyperlink-format", "editor://{path}"}, "src/a b.txt", "\x1b]8;;editor://" + filepath.Dir(abs) + "/a b.txt\x1b\\src/a b.txt\x1b]8;;\x1b\\"},
+		// there's nothing to link stdin to
+		{[]string{"hyperlink", "true"}, "stdin", "stdin"},
+	}
+	for _, test := range tests {
+		setFlags(t, test.flags...)
+		if got := link(test.file); got != test.want {
+			t.Errorf("%q linked %s as %q, want %q", test.flags, test.file, got, test.want)
+		}
+	}
+
+	urls := []struct {
+		name string
+		want string
+	}{
+		{"/src/a.go", "file:///src/a.go"},
+		{"/src/a b#1%.txt", "file:///src/a%20b%231%25.txt"},
+		{"C:/src/a.go", "file:///C:/src/a.go"},
+	}
+	for _, test := range urls {
+		if got := fileURL(test.name); got != test.want {
+			t.Errorf("fileURL(%q) = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestSkipEmptyLines(t *testing.T) {
+	input := "a\n\nfoo\n   \nb\n"
+	tests := []struct {
+		flags   []string
+		pattern string
+		want    []string
+	}{
+		// empty lines don't contain the pattern, so -v selects them
+		{nil, "foo", []string{"a", "", "", "b"}},
+		{[]string{"skip-empty-lines", "true"}, "foo", []string{"a", "b"}},
+		{[]string{"skip-empty-lines", "true", "trim", "false"}, "foo", []string{"a", "   ", "b"}},
+		// but every line contains the empty pattern
+		{nil, "", nil},
+	}
+	for _, test := range tests {
+		setFlags(t, append([]string{"v", "true"}, test.flags...)...)
+		result, lines := scan(t, input, test.pattern)
+		if !reflect.DeepEqual(lines, test.want) || result.lines != len(test.want) {
+			t.Errorf("-v %q selected %q, want %q", test.flags, lines, test.want)
+		}
+	}
+}
+
+func TestFirstFile(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"tree/a.txt":     "bar\n",
+		"tree/b.txt":     "foo\nfoo\n",
+		"tree/c.txt":     "foo\n",
+		"tree/sub/d.txt": "foo\n",
+	})
+	stdout, stderr, status := runGrep(t, dir, "", "-report-skipped", "-r", "-first-file", "foo", "tree")
+	if stdout != "tree/b.txt\n" || status != exitMatchesFound {
+		t.Errorf("-first-file printed %q and exited with %d, want %q and 0", stdout, status, "tree/b.txt\n")
+	}
+	want := "2 files skipped:\n  tree/c.txt: not searched, -first-file found a match\n  tree/sub/d.txt: not searched, -first-file found a match\n"
+	if stderr != want {
+		t.Errorf("-first-file skipped %q, want %q", stderr, want)
+	}
+	if stdout, _, status := runGrep(t, dir, "", "-r", "-first-file", "baz", "tree"); stdout != "" || status != exitNoMatches {
+		t.Errorf("-first-file with no matches printed %q and exited with %d, want nothing and 1", stdout, status)
+	}
+}
+
+func TestMaxBytesScanned(t *testing.T) {
+	tests := []struct {
+		max   string
+		input string
+		read  int64
+		err   error
+	}{
+		{"0", "abcdef", 6, nil},
+		{"10", "abcdef", 6, nil},
+		// the input fits exactly
+		{"6", "abcdef", 6, nil},
+		{"5", "abcdef", 5, errTooMuchInput},
+		{"1", "abcdef", 1, errTooMuchInput},
+	}
+	for _, test := range tests {
+		setFlags(t, "max-bytes-scanned", test.max)
+		_, err := ioutil.ReadAll(withByteLimit(strings.NewReader(test.input)))
+		if bytesRead != test.read || err != test.err {
+			t.Errorf("-max-bytes-scanned %s read %d bytes of %q and gave %v, want %d and %v", test.max, bytesRead, test.input, err, test.read, test.err)
+		}
+	}
+
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"a.txt": "abc\n",
+		"b.txt": "x\n",
+		"c.txt": "",
+	})
+	runs := []struct {
+		args   []string
+		stderr string
+		status int
+	}{
+		{[]string{"-max-bytes-scanned", "4", "b", "a.txt", "c.txt"}, "", exitMatchesFound},
+		{[]string{"-max-bytes-scanned", "4", "b", "a.txt", "b.txt"}, "Aborted after reading 4 bytes\n", exitError},
+		{[]string{"-max-bytes-scanned", "2", "x", "a.txt", "b.txt"}, "Aborted after reading 2 bytes\n", exitError},
+	}
+	for _, run := range runs {
+		_, stderr, status := runGrep(t, dir, "", run.args...)
+		if stderr != run.stderr || status != run.status {
+			t.Errorf("grep %s printed %q and exited with %d, want %q and %d", strings.Join(run.args, " "), stderr, status, run.stderr, run.status)
+		}
+	}
+}
+
+func TestSymlinkDuplicates(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"tree/real.txt": "foo\n",
+	})
+	tree := filepath.Join(dir, "tree")
+	for _, link := range []string{"link1", "link2"} {
+		if err := os.Symlink(filepath.Join(tree, "real.txt"), filepath.Join(tree, link)); err != nil {
+			t.Skip("can't create symbolic links:", err)
+		}
+	}
+	all := []string{tree + "/link1", tree + "/link2", tree + "/real.txt"}
+	tests := []struct {
+		flags []string
+		want  []string
+	}{
+		{[]string{"r", "true"}, []string{tree + "/real.txt"}},
+		{[]string{"R", "true"}, []string{tree + "/link1"}},
+		{[]string{"follow-file-symlinks", "true"}, []string{tree + "/link1"}},
+		{[]string{"R", "true", "allow-symlink-duplicates", "true"}, all},
+		{[]string{"follow-file-symlinks", "true", "allow-symlink-duplicates", "true"}, all},
+	}
+	for _, test := range tests {
+		// main sets -r along with -follow-file-symlinks
+		setFlags(t, append([]string{"r", "true"}, test.flags...)...)
+		if got := inputFiles([]string{tree}); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%q found %q, want %q", test.flags, got, test.want)
+		}
+	}
+
+	stdout, _, _ := runGrep(t, dir, "", "-R", "foo", "tree")
+	if want := "tree/link1: foo\n"; stdout != want {
+		t.Errorf("grep -R printed %q, want %q", stdout, want)
+	}
+}
+
+func TestReportSkipped(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"tree/a.txt":     "foo\n",
+		"tree/b.log":     "foo\n",
+		"tree/sub/c.txt": "foo\n",
+	})
+	if err := os.Symlink("a.txt", filepath.Join(dir, "tree/link")); err != nil {
+		t.Skip("can't create symbolic links:", err)
+	}
+	if err := os.Symlink("missing", filepath.Join(dir, "dangling")); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		args   []string
+		report string
+	}{
+		{[]string{"-r", "-max-depth", "1", "-include", "*.txt", "foo", "tree", "dangling"},
+			"4 files skipped:\n" +
+				"  tree/b.log: filtered out by -include/-exclude/-glob\n" +
+				"  tree/link: a symbolic link (use -R to follow it)\n" +
+				"  tree/sub: a directory deeper than -max-depth\n" +
+				"  dangling: unreadable: no such file or directory\n"},
+		{[]string{"foo", "tree"}, "1 files skipped:\n  tree: a directory (use -r to search it)\n"},
+		{[]string{"-R", "-cap-per-type", "1", "foo", "tree"},
+			"2 files skipped:\n" +
+				"  tree/link: already searched through another link\n" +
+				"  tree/sub/c.txt: not searched, -cap-per-type reached for .txt\n"},
+		{[]string{"-R", "-filename-pattern", "^[ab]", "foo", "tree"},
+			"2 files skipped:\n" +
+				"  tree/link: filtered out by -filename-pattern\n" +
+				"  tree/sub/c.txt: filtered out by -filename-pattern\n"},
+	}
+	for _, test := range tests {
+		_, stderr, _ := runGrep(t, dir, "", append([]string{"-report-skipped"}, test.args...)...)
+		if !strings.HasSuffix(stderr, test.report) {
+			t.Errorf("grep -report-skipped %s printed\n%s\nwant it to end with\n%s", strings.Join(test.args, " "), stderr, test.report)
+		}
+	}
+}
+
+func TestCountTotal(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"a.txt": "foo\nfoo\nbar\n",
+		"b.txt": "bar\n",
+		"c.txt": "foo bar\n",
+	})
+	tests := []struct {
+		args   []string
+		want   string
+		status int
+	}{
+		{[]string{"-c", "-total", "foo", "a.txt", "b.txt", "c.txt"}, "a.txt: 2\nb.txt: 0\nc.txt: 1\ntotal:3\n", exitMatchesFound},
+		{[]string{"-c", "-total", "-count-width", "3", "foo", "a.txt", "b.txt", "c.txt"}, "a.txt:   2\nb.txt:   0\nc.txt:   1\ntotal:  3\n", exitMatchesFound},
+		{[]string{"-bytes", "-total", "foo", "a.txt", "b.txt", "c.txt"}, "a.txt: 8\nb.txt: 0\nc.txt: 8\ntotal:16\n", exitMatchesFound},
+		{[]string{"-c", "-total", "baz", "a.txt", "b.txt"}, "a.txt: 0\nb.txt: 0\ntotal:0\n", exitNoMatches},
+		{[]string{"-total", "foo", "a.txt"}, "", exitError},
+	}
+	for _, test := range tests {
+		stdout, _, status := runGrep(t, dir, "", test.args...)
+		if stdout != test.want || status != test.status {
+			t.Errorf("grep %s printed %q and exited with %d, want %q and %d", strings.Join(test.args, " "), stdout, status, test.want, test.status)
+		}
+	}
+}
+
+func TestTrimDisplay(t *testing.T) {
+	tests := []struct {
+		flags   []string
+		pattern string
+		want    []string
+	}{
+		// matched with the whitespace, printed without it
+		{nil, "  foo", []string{"foo"}},
+		{nil, "foo  ", []string{"foo"}},
+		{[]string{"x", "true"}, "foo", nil},
+		{[]string{"x", "true"}, "  foo  ", []string{"foo"}},
+		{[]string{"first-match-offset", "true"}, "foo", []string{"6"}},
+	}
+	for _, test := range tests {
+		setFlags(t, append([]string{"trim-display", "true"}, test.flags...)...)
+		if _, got := scan(t, "abc\n  foo  \n", test.pattern); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("-trim-display %q looking for %q sent %q, want %q", test.flags, test.pattern, got, test.want)
+		}
+	}
+	// without -trim-display, the whitespace is trimmed before matching
+	setFlags(t)
+	if _, got := scan(t, "  foo  \n", "  foo"); got != nil {
+		t.Errorf("looking for %q sent %q, want nothing", "  foo", got)
+	}
+}
+
+func TestCountStdinLabel(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"a.txt": "foo\n",
+	})
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"-c", "foo"}, "2\n"},
+		{[]string{"-c", "foo", "-"}, "2\n"},
+		{[]string{"-c", "foo", "a.txt", "-"}, "a.txt: 1\nstdin: 2\n"},
+		{[]string{"-c", "foo", "-", "a.txt"}, "stdin: 2\na.txt: 1\n"},
+		// only counts go unlabelled
+		{[]string{"foo"}, "stdin: foo\nstdin: foo bar\n"},
+	}
+	for _, test := range tests {
+		if stdout, _, _ := runGrep(t, dir, "foo\nfoo bar\nbar\n", test.args...); stdout != test.want {
+			t.Errorf("grep %s printed %q, want %q", strings.Join(test.args, " "), stdout, test.want)
+		}
+	}
+}
+
+func TestSummaryJSON(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"a.txt": "foo foo\nbar\n",
+		"b.txt": "foo\n",
+		"c.txt": "bar\n",
+	})
+	tests := []struct {
+		files []string
+		want  map[string]int
+	}{
+		{[]string{"a.txt", "b.txt", "c.txt"}, map[string]int{
+			"files_searched": 3,
+			"files_matched":  2,
+			"matched_lines":  2,
+			"total_matches":  3,
+			"bytes_scanned":  20,
+			"errors":         0,
+		}},
+		{[]string{"a.txt", "missing.txt"}, map[string]int{
+			"files_searched": 1,
+			"files_matched":  1,
+			"matched_lines":  1,
+			"total_matches":  2,
+			"bytes_scanned":  12,
+			"errors":         1,
+		}},
+	}
+	for _, test := range tests {
+		_, stderr, _ := runGrep(t, dir, "", append([]string{"-summary-json", "foo"}, test.files...)...)
+		// the summary is the last line
+		lines := strings.Split(strings.TrimSuffix(stderr, "\n"), "\n")
+		var got map[string]int
+		if err := json.Unmarshal([]byte(lines[len(lines)-1]), &got); err != nil {
+			t.Fatalf("-summary-json printed %q: %v", stderr, err)
+		}
+		if elapsed, ok := got["elapsed_ms"]; !ok || elapsed < 0 {
+			t.Errorf("-summary-json gave an elapsed_ms of %d", elapsed)
+		}
+		delete(got, "elapsed_ms")
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("-summary-json over %q gave %v, want %v", test.files, got, test.want)
+		}
+	}
+}
+
+func TestCapPerFile(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"a.txt": "foo1\nbar\nfoo2\nfoo3\nfoo4\nfoo5\n",
+		"b.txt": "foo6\n",
+	})
+	tests := []struct {
+		args   []string
+		want   string
+		stderr string
+		status int
+	}{
+		{[]string{"-cap-per-file", "2", "foo", "a.txt", "b.txt"}, "a.txt: foo1\na.txt: foo2\na.txt: [+3 more]\nb.txt: foo6\n", "", exitMatchesFound},
+		{[]string{"-cap-per-file", "5", "foo", "a.txt"}, "a.txt: foo1\na.txt: foo2\na.txt: foo3\na.txt: foo4\na.txt: foo5\n", "", exitMatchesFound},
+		// the counts are of every selected line
+		{[]string{"-cap-per-file", "2", "-c", "foo", "a.txt", "b.txt"}, "a.txt: 5\nb.txt: 1\n", "", exitMatchesFound},
+		{[]string{"-cap-per-file", "2", "-stats", "foo", "a.txt"}, "a.txt: foo1\na.txt: foo2\na.txt: [+3 more]\n", "1 files searched\n1 files contained matches\n5 matched lines\n5 matches\n", exitMatchesFound},
+		{[]string{"-cap-per-file", "2", "-raw", "foo", "a.txt"}, "", "-cap-per-file can't be used with -raw\n", exitError},
+	}
+	for _, test := range tests {
+		stdout, stderr, status := runGrep(t, dir, "", test.args...)
+		if stdout != test.want || stderr != test.stderr || status != test.status {
+			t.Errorf("grep %s printed %q and %q and exited with %d, want %q, %q and %d", strings.Join(test.args, " "), stdout, stderr, status, test.want, test.stderr, test.status)
+		}
+	}
+}
+
+func TestASCIIOnly(t *testing.T) {
+	lower := []struct {
+		s, want string
+	}{
+		{"", ""},
+		{"abc", "abc"},
+		{"ABC xyz", "abc xyz"},
+		// only ASCII letters change
+		{"ÀBÇ", "ÀbÇ"},
+		{"\u212a", "\u212a"},
+	}
+	for _, test := range lower {
+		if got := lowerASCII(test.s); got != test.want {
+			t.Errorf("lowerASCII(%q) = %q, want %q", test.s, got, test.want)
+		}
+	}
+	folds := []struct {
+		s, t string
+		want bool
+	}{
+		{"ABC", "abc", true},
+		{"abc", "abd", false},
+		{"abc", "ab", false},
+		{"À", "à", false},
+		{"\u212a", "k", false},
+		{"[", "{", false},
+	}
+	for _, test := range folds {
+		if got := equalFoldASCII(test.s, test.t); got != test.want {
+			t.Errorf("equalFoldASCII(%q, %q) = %v, want %v", test.s, test.t, got, test.want)
+		}
+	}
+
+	tests := []struct {
+		args   []string
+		want   string
+		stderr string
+		status int
+	}{
+		{[]string{"-ascii-only", "ü"}, "", "-ascii-only was given, but the pattern isn't ASCII: \"ü\"\n", exitError},
+		{[]string{"-ascii-only", "-check-pattern", "ü"}, "", "-ascii-only was given, but the pattern isn't ASCII: \"ü\"\n", exitError},
+		{[]string{"-ascii-only", "-i", "-c", "foo"}, "2\n", "", exitMatchesFound},
+		{[]string{"-ascii-only", "-i", "-x", "-c", "foo"}, "1\n", "", exitMatchesFound},
+		// only ASCII letters are folded, so the Kelvin sign isn't a k
+		{[]string{"-ascii-only", "-i", "-x", "-c", "k"}, "0\n", "", exitNoMatches},
+		{[]string{"-i", "-x", "-c", "k"}, "1\n", "", exitMatchesFound},
+		{[]string{"-verbose", "-i", "-c", "k"}, "1\n", "the pattern is ASCII, so if the input is too, -ascii-only would make -i faster\n", exitMatchesFound},
+		{[]string{"-verbose", "-i", "-ascii-only", "-c", "k"}, "0\n", "", exitNoMatches},
+	}
+	for _, test := range tests {
+		stdout, stderr, status := runGrep(t, "", "FOO\nFoo bar\n\u212a\n", test.args...)
+		if stdout != test.want || stderr != test.stderr || status != test.status {
+			t.Errorf("grep %s printed %q and %q and exited with %d, want %q, %q and %d", strings.Join(test.args, " "), stdout, stderr, status, test.want, test.stderr, test.status)
+		}
+	}
+}
+
+func TestShowDepth(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"tree/top.txt":      "foo\n",
+		"tree/a/mid.txt":    "foo\n",
+		"tree/a/b/deep.txt": "foo\n",
+		"other.txt":         "foo\n",
+	})
+	stdout, _, _ := runGrep(t, dir, "", "-r", "-show-depth", "foo", "tree", "other.txt")
+	want := "[3] tree/a/b/deep.txt: foo\n[2] tree/a/mid.txt: foo\n[1] tree/top.txt: foo\n[0] other.txt: foo\n"
+	if stdout != want {
+		t.Errorf("-show-depth printed %q, want %q", stdout, want)
+	}
+	stdout, _, _ = runGrep(t, dir, "", "-r", "-show-depth", "-l", "foo", "tree/a")
+	if want := "[2] tree/a/b/deep.txt\n[1] tree/a/mid.txt\n"; stdout != want {
+		t.Errorf("-show-depth -l printed %q, want %q", stdout, want)
+	}
+}
+
+func TestCountWidth(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"a": "foo\n",
+		"b": strings.Repeat("foo\n", 12),
+		"c": strings.Repeat("foo\n", 123),
+		"d": strings.Repeat("foo\n", 12345),
+	})
+	tests := []struct {
+		width string
+		want  string
+	}{
+		{"0", "a: 1\nb: 12\nc: 123\nd: 12345\n"},
+		{"4", "a:    1\nb:   12\nc:  123\nd: 12345\n"},
+	}
+	for _, test := range tests {
+		if stdout, _, _ := runGrep(t, dir, "", "-c", "-count-width", test.width, "foo", "a", "b", "c", "d"); stdout != test.want {
+			t.Errorf("-count-width %s printed %q, want %q", test.width, stdout, test.want)
+		}
+	}
+}
+
+func TestBinaryScanBytes(t *testing.T) {
+	// the NUL byte is 100 bytes in
+	input := strings.Repeat("x", 99) + "\n\x00\nmatch\n"
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"f": input,
+	})
+	tests := []struct {
+		args  []string
+		stdin bool
+		want  string
+	}{
+		{nil, false, "f: Binary File Matches\n"},
+		{[]string{"-binary-scan-bytes", "101"}, false, "f: Binary File Matches\n"},
+		{[]string{"-binary-scan-bytes", "100"}, false, "f: match\n"},
+		{[]string{"-binary-scan-bytes", "16"}, false, "f: match\n"},
+		{[]string{"-binary-scan-bytes", "0"}, false, "f: match\n"},
+		{nil, true, "stdin: Binary File Matches\n"},
+		{[]string{"-binary-scan-bytes", "16"}, true, "stdin: match\n"},
+		{[]string{"-binary-scan-bytes", "0"}, true, "stdin: match\n"},
+	}
+	for _, test := range tests {
+		args, stdin := append(test.args, "match"), ""
+		if test.stdin {
+			stdin = input
+		} else {
+			args = append(args, "f")
+		}
+		if stdout, _, _ := runGrep(t, dir, stdin, args...); stdout != test.want {
+			t.Errorf("grep %s printed %q, want %q", strings.Join(args, " "), stdout, test.want)
+		}
+	}
+}
+
+func TestShowConfig(t *testing.T) {
+	stdout, _, status := runGrep(t, "", "", "-show-config", "-i", "-limit", "3", "-include", "*.go", "-glob", "!*_test.go")
+	if status != exitMatchesFound {
+		t.Errorf("-show-config exited with %d, want 0", status)
+	}
+	for _, want := range []string{
+		"-i=true (command line)\n",
+		"-limit=3 (command line)\n",
+		"-v=false (default)\n",
+		"-glob-match=basename (default)\n",
+		"rule: include *.go\nrule: exclude *_test.go\n",
+	} {
+		if !strings.Contains(stdout, want) {
+			t.Errorf("-show-config printed\n%s\nwithout %q", stdout, want)
+		}
+	}
+}
+
+func TestExitCount(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"a.txt": "foo\nfoo\n",
+		"b.txt": "foo\n",
+		"c.txt": "bar\n",
+		"d.txt": "foo\n",
+	}
+	for i := 0; i < 130; i++ {
+		files[fmt.Sprintf("many/%d.txt", i)] = "foo\n"
+	}
+	writeFiles(t, dir, files)
+	tests := []struct {
+		args   []string
+		status int
+	}{
+		{[]string{"foo", "a.txt", "b.txt", "c.txt", "d.txt"}, 3},
+		{[]string{"-l", "foo", "a.txt", "b.txt", "c.txt", "d.txt"}, 3},
+		{[]string{"foo", "c.txt"}, 0},
+		{[]string{"-r", "foo", "many"}, maxExitCount},
+		{[]string{"foo", "a.txt", "missing.txt"}, exitCountError},
+	}
+	for _, test := range tests {
+		if _, _, status := runGrep(t, dir, "", append([]string{"-exit-count"}, test.args...)...); status != test.status {
+			t.Errorf("grep -exit-count %s exited with %d, want %d", strings.Join(test.args, " "), status, test.status)
+		}
+	}
+}
+
+func TestFollowFileSymlinks(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"tree/a.txt":     "foo\n",
+		"outside/b.txt":  "foo\n",
+		"outside/in.txt": "foo\n",
+	})
+	tree := filepath.Join(dir, "tree")
+	if err := os.Symlink(filepath.Join(dir, "outside/b.txt"), filepath.Join(tree, "filelink")); err != nil {
+		t.Skip("can't create symbolic links:", err)
+	}
+	if err := os.Symlink(filepath.Join(dir, "outside"), filepath.Join(tree, "dirlink")); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		flags []string
+		want  []string
+	}{
+		{[]string{"r", "true"}, []string{tree + "/a.txt"}},
+		{[]string{"r", "true", "follow-file-symlinks", "true"}, []string{tree + "/a.txt", tree + "/filelink"}},
+		{[]string{"R", "true"}, []string{tree + "/a.txt", tree + "/dirlink/b.txt", tree + "/dirlink/in.txt"}},
+	}
+	for _, test := range tests {
+		setFlags(t, test.flags...)
+		if got := inputFiles([]string{tree}); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%q found %q, want %q", test.flags, got, test.want)
+		}
+	}
+
+	stdout, stderr, _ := runGrep(t, dir, "", "-follow-file-symlinks", "-report-skipped", "foo", "tree")
+	if want := "tree/a.txt: foo\ntree/filelink: foo\n"; stdout != want {
+		t.Errorf("-follow-file-symlinks printed %q, want %q", stdout, want)
+	}
+	if want := "1 files skipped:\n  tree/dirlink: a symbolic link to a directory (use -R to follow it)\n"; stderr != want {
+		t.Errorf("-follow-file-symlinks skipped %q, want %q", stderr, want)
+	}
+}
+
+func TestCapPerType(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"tree/a0.go": "bar\n",
+		"tree/a1.go": "foo\n",
+		"tree/a2.go": "foo\n",
+		"tree/a3.go": "foo\n",
+		"tree/a4.go": "foo\n",
+		"tree/b1.md": "foo\n",
+		"tree/b2.md": "bar\n",
+		"tree/b3.md": "foo\n",
+		"tree/b4.md": "foo\n",
+		"tree/c":     "foo\n",
+	})
+	stdout, _, _ := runGrep(t, dir, "", "-r", "-l", "-cap-per-type", "2", "foo", "tree")
+	if want := "tree/a1.go\ntree/a2.go\ntree/b1.md\ntree/b3.md\ntree/c\n"; stdout != want {
+		t.Errorf("-cap-per-type 2 printed %q, want %q", stdout, want)
+	}
+	stdout, _, _ = runGrep(t, dir, "", "-r", "-c", "-cap-per-type", "1", "foo", "tree")
+	if want := "tree/a0.go: 0\ntree/a1.go: 1\ntree/b1.md: 1\ntree/c: 1\n"; stdout != want {
+		t.Errorf("-cap-per-type 1 -c printed %q, want %q", stdout, want)
+	}
+}
+
+func TestCheckPattern(t *testing.T) {
+	tests := []struct {
+		args   []string
+		stderr string
+		status int
+	}{
+		{[]string{"foo"}, "", exitMatchesFound},
+		// nothing is read, so missing files don't matter
+		{[]string{"foo", "missing.txt"}, "", exitMatchesFound},
+		{[]string{"-l", "-L", "foo"}, "-l and -L can't be used together\n", exitError},
+		{[]string{"-filename-pattern", "(", "foo"}, "Invalid value for -filename-pattern: error parsing regexp: missing closing ): `(`\n", exitError},
+		{[]string{"-newer-than", "yesterday", "foo"}, "Invalid value for -newer-than: yesterday\n", exitError},
+		{[]string{"-limit", "-1", "foo"}, "Invalid value for -limit: -1\n", exitError},
+		{[]string{"foo", "-", "-"}, "- (stdin) can only be given once\n", exitError},
+	}
+	for _, test := range tests {
+		stdout, stderr, status := runGrep(t, "", "foo\n", append([]string{"-check-pattern"}, test.args...)...)
+		if stdout != "" || stderr != test.stderr || status != test.status {
+			t.Errorf("grep -check-pattern %s printed %q and %q and exited with %d, want %q and %d", strings.Join(test.args, " "), stdout, stderr, status, test.stderr, test.status)
+		}
+	}
+}
+
+func TestByteCount(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"a.txt":    "foo bar\nbaz\nfoo\n",
+		"b.txt":    "baz\n",
+		"crlf.txt": "foo\r\nbaz\r\n",
+		"last.txt": "foo\nfoo",
+	})
+	tests := []struct {
+		args   []string
+		stdin  string
+		want   string
+		status int
+	}{
+		{[]string{"-bytes", "foo", "a.txt", "b.txt"}, "", "a.txt: 12\nb.txt: 0\n", exitMatchesFound},
+		{[]string{"-bytes", "foo", "crlf.txt", "last.txt"}, "", "crlf.txt: 5\nlast.txt: 7\n", exitMatchesFound},
+		{[]string{"-bytes", "-v", "foo", "a.txt"}, "", "a.txt: 4\n", exitMatchesFound},
+		{[]string{"-bytes", "foo"}, "foo\nbar\n", "4\n", exitMatchesFound},
+		{[]string{"-bytes", "-c", "foo", "a.txt"}, "", "", exitError},
+	}
+	for _, test := range tests {
+		stdout, _, status := runGrep(t, dir, test.stdin, test.args...)
+		if stdout != test.want || status != test.status {
+			t.Errorf("grep %s printed %q and exited with %d, want %q and %d", strings.Join(test.args, " "), stdout, status, test.want, test.status)
+		}
+	}
+}
+
+func TestCountNoTrailingNewline(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"a.txt": "foo\n",
+		"b.txt": "bar\n",
+	})
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"-c", "foo"}, "2\n"},
+		{[]string{"-c", "-no-trailing-newline", "foo"}, "2"},
+		{[]string{"-c", "-no-trailing-newline", "baz"}, "0"},
+		{[]string{"-bytes", "-no-trailing-newline", "foo"}, "12"},
+		{[]string{"-c", "-no-trailing-newline", "foo", "a.txt", "b.txt"}, "a.txt: 1\nb.txt: 0"},
+		{[]string{"-c", "-total", "-no-trailing-newline", "foo", "a.txt", "b.txt"}, "a.txt: 1\nb.txt: 0\ntotal:1"},
+		{[]string{"-total-matches", "-no-trailing-newline", "foo"}, "3"},
+	}
+	for _, test := range tests {
+		if stdout, _, _ := runGrep(t, dir, "foo\nfoo foo\n", test.args...); stdout != test.want {
+			t.Errorf("grep %s printed %q, want %q", strings.Join(test.args, " "), stdout, test.want)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var outputDir = flag.String("output-dir", "", "Write the selected lines of each input file to a file under this directory, at the path the input has below its directory operand (or its base name, for operands), instead of to stdout")
+
+// searchRoots holds the directory operands walked by a recursive search,
+// and fileRoots the operand each file found inside them was found under,
+// so that output-dir can mirror the files' paths below their operands.
+// They are only written while the list of files is built.
+var (
+	searchRoots []string
+	fileRoots   = make(map[string]string)
+)
+
+// outputPaths works out where output-dir writes the records for each of
+// files: the file's path below the directory operand it was found under,
+// or just its base name for the operands themselves, under dir.  It fails
+// if dir is inside a directory being searched, if an output file would be
+// one of the inputs, or if two inputs would share an output file.
+func outputPaths(dir string, files []string) (map[string]string, error) {
+	realDir := realPath(dir)
+	for _, root := range searchRoots {
+		if within(realDir, realPath(root)) {
+			return nil, fmt.Errorf("-output-dir %s is inside %s, which is being searched", dir, root)
+		}
+	}
+	inputs := make(map[string]bool)
+	for _, file := range files {
+		if file != "-" {
+			inputs[realPath(file)] = true
+		}
+	}
+	paths := make(map[string]string)
+	owners := make(map[string]string)
+	for _, file := range files {
+		name, rel := file, filepath.Base(file)
+		if file == "-" {
+			name, rel = "stdin", "stdin"
+		} else if root, ok := fileRoots[file]; ok {
+			rel, _ = filepath.Rel(root, file)
+		}
+		// a file given more than once (by the same name or another one)
+		// is written to the same place
+		if _, ok := paths[name]; ok {
+			continue
+		}
+		out := filepath.Join(dir, rel)
+		if owner, ok := owners[out]; ok && realPath(owner) != realPath(file) {
+			return nil, fmt.Errorf("-output-dir: the output for %s and %s would both go to %s", owner, name, out)
+		}
+		if inputs[realPath(out)] {
+			return nil, fmt.Errorf("-output-dir: the output for %s would overwrite the input %s", name, out)
+		}
+		paths[name], owners[out] = out, file
+	}
+	return paths, nil
+}
+
+// realPath returns the absolute path of name, with symbolic links
+// resolved if it exists.
+func realPath(name string) string {
+	if real, err := filepath.EvalSymlinks(name); err == nil {
+		name = real
+	}
+	if abs, err := filepath.Abs(name); err == nil {
+		return abs
+	}
+	return name
+}
+
+// within reports whether the absolute path name is dir or inside it.
+func within(name, dir string) bool {
+	rel, err := filepath.Rel(dir, name)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// A splitOutput writes the records for each input to a file of its own,
+// at the path outputPaths chose for it, for the output-dir flag.  Records
+// mostly arrive one input at a time, so only the current input's file is
+// kept open, and it is reopened to add to it if that input comes up again.
+type splitOutput struct {
+	paths   map[string]string // output file for each input
+	created map[string]bool   // output files already created
+	name    string            // the input the open file is for
+	file    *os.File
+	w       *bufio.Writer
+}
+
+func newSplitOutput(paths map[string]string) *splitOutput {
+	return &splitOutput{paths: paths, created: make(map[string]bool)}
+}
+
+// write writes the line of m to the file for m's input, creating the file
+// (and any directories it needs) the first time that input is seen.
+func (s *splitOutput) write(m *match) error {
+	if s.file == nil || m.file != s.name {
+		if err := s.close(); err != nil {
+			return err
+		}
+		name, ok := s.paths[m.file]
+		if !ok {
+			return fmt.Errorf("-output-dir: no output file for %s", m.file)
+		}
+		if err := os.MkdirAll(filepath.Dir(name), 0777); err != nil {
+			return err
+		}
+		flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+		if s.created[name] {
+			flags = os.O_WRONLY | os.O_APPEND
+		}
+		file, err := os.OpenFile(name, flags, 0666)
+		if err != nil {
+			return err
+		}
+		s.created[name] = true
+		s.name, s.file, s.w = m.file, file, bufio.NewWriterSize(file, *outputBufferSize)
+	}
+	_, err := fmt.Fprintln(s.w, m.line)
+	return err
+}
+
+// close flushes and closes the file currently open, if there is one.
+// A nil *splitOutput has nothing to close.
+func (s *splitOutput) close() error {
+	if s == nil || s.file == nil {
+		return nil
+	}
+	err := s.w.Flush()
+	if cerr := s.file.Close(); err == nil {
+		err = cerr
+	}
+	s.file = nil
+	return err
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestOutputDir(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"src/a.txt":     "foo1\nbar\n",
+		"src/sub/b.txt": "bar\nfoo2\nfoo3\n",
+		"src/sub/c.txt": "bar\n",
+		"other.txt":     "foo4\n",
+	})
+	stdout, _, status := runGrep(t, dir, "", "-r", "-output-dir", "out", "foo", "src", "other.txt")
+	if stdout != "" || status != exitMatchesFound {
+		t.Errorf("-output-dir printed %q and exited with %d, want nothing and 0", stdout, status)
+	}
+	want := map[string]string{
+		"a.txt":     "foo1\n",
+		"sub/b.txt": "foo2\nfoo3\n",
+		"other.txt": "foo4\n",
+	}
+	got := make(map[string]string)
+	filepath.Walk(filepath.Join(dir, "out"), func(name string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			contents, _ := ioutil.ReadFile(name)
+			rel, _ := filepath.Rel(filepath.Join(dir, "out"), name)
+			got[rel] = string(contents)
+		}
+		return err
+	})
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("-output-dir wrote %q, want %q", got, want)
+	}
+
+	writeFiles(t, dir, map[string]string{
+		"x/a.txt": "foo\n",
+	})
+	errors := []struct {
+		args []string
+		err  string
+	}{
+		{[]string{"-r", "-output-dir", "src/out", "foo", "src"}, "is inside src, which is being searched"},
+		{[]string{"-output-dir", "out2", "foo", "src/a.txt", "x/a.txt"}, "would both go to out2/a.txt"},
+		{[]string{"-output-dir", "src", "foo", "other.txt", "src/a.txt"}, "would overwrite the input src/a.txt"},
+	}
+	for _, test := range errors {
+		_, stderr, status := runGrep(t, dir, "", test.args...)
+		if !strings.Contains(stderr, test.err) || status != exitError {
+			t.Errorf("grep %s printed %q and exited with %d, want an error containing %q", strings.Join(test.args, " "), stderr, status, test.err)
+		}
+	}
+}
+
+func TestOutputPaths(t *testing.T) {
+	setFlags(t)
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"a.txt": "",
+	})
+	a := filepath.Join(dir, "a.txt")
+	paths, err := outputPaths("out", []string{a, "-", a})
+	want := map[string]string{
+		a:       filepath.Join("out", "a.txt"),
+		"stdin": filepath.Join("out", "stdin"),
+	}
+	if err != nil || !reflect.DeepEqual(paths, want) {
+		t.Errorf("outputPaths gave %q and %v, want %q", paths, err, want)
+	}
+}
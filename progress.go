@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// progressInterval is how often the progress line is redrawn, unless the
+// progress-interval flag says otherwise.
+const progressInterval = 200 * time.Millisecond
+
+var (
+	progressJSON  = flag.Bool("progress-json", false, "Like -progress, but write the progress to stderr as a JSON object per line, like {\"searched\":N,\"matched\":M,\"current\":\"path\"}, whether or not it is a terminal")
+	progressEvery = flag.Duration("progress-interval", progressInterval, "How often -progress and -progress-json report progress")
+)
+
+// A progress reports how far a search has got, as a single line that is
+// redrawn in place using carriage returns, or as a stream of JSON objects
+// (one per line) for programs to read.  It is updated both by the
+// goroutine that scans files and by the one printing matches, so all of
+// its methods are safe for concurrent use.  A nil *progress does nothing.
+type progress struct {
+	mu       sync.Mutex
+	out      io.Writer
+	now      func() time.Time
+	last     time.Time
+	searched int
+	matches  int // lines selected in the files searched
+	current  string
+	width    int // length of the line currently displayed, 0 if none
+	json     bool
+}
+
+// newProgress returns a progress that writes to out, or nil if out
+// isn't a terminal (where carriage returns would only add noise).
+func newProgress(out *os.File) *progress {
+	if !isTerminal(out) {
+		return nil
+	}
+	return &progress{out: out, now: time.Now}
+}
+
+// newJSONProgress returns a progress that writes JSON objects to out.
+func newJSONProgress(out io.Writer) *progress {
+	return &progress{out: out, now: time.Now, json: true}
+}
+
+// isTerminal reports whether f is a character device.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// startFile records that name is about to be searched.
+func (p *progress) startFile(name string) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.current = name
+	p.update()
+}
+
+// endFile records that the current file has been searched, and that
+// lines were selected in it.
+func (p *progress) endFile(lines int) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.searched++
+	p.matches += lines
+	p.update()
+}
+
+// output is called just before a record is printed.  It erases the
+// progress line to keep it from being mixed up with the output; it is
+// redrawn on the next update.
+func (p *progress) output() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.clear()
+}
+
+// done erases the progress line for good, or with JSON writes the final
+// progress (however recently the last was written).
+func (p *progress) done() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.json {
+		p.current = ""
+		p.write()
+		return
+	}
+	p.clear()
+}
+
+// update redraws the progress line, if it hasn't been drawn within the
+// last progress-interval.  p.mu must be held.
+func (p *progress) update() {
+	now := p.now()
+	if now.Sub(p.last) < *progressEvery {
+		return
+	}
+	p.last = now
+	p.write()
+}
+
+// write draws the progress line, or writes it as JSON.  p.mu must be held.
+func (p *progress) write() {
+	if p.json {
+		// encoding a struct of ints and a string can't fail
+		json.NewEncoder(p.out).Encode(struct {
+			Searched int    `json:"searched"`
+			Matched  int    `json:"matched"`
+			Current  string `json:"current"`
+		}{p.searched, p.matches, p.current})
+		return
+	}
+	line := fmt.Sprintf("%d files searched, %d matches, %s", p.searched, p.matches, p.current)
+	pad := ""
+	if len(line) < p.width {
+		pad = strings.Repeat(" ", p.width-len(line))
+	}
+	fmt.Fprintf(p.out, "\r%s%s\r", line, pad)
+	p.width = len(line)
+}
+
+// clear erases the progress line, if one is displayed.  p.mu must be held.
+func (p *progress) clear() {
+	if p.width == 0 {
+		return
+	}
+	fmt.Fprintf(p.out, "\r%s\r", strings.Repeat(" ", p.width))
+	p.width = 0
+	// make sure the next update draws the line again
+	p.last = time.Time{}
+}
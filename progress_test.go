@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A fakeClock is a clock for a progress that only moves when told to.
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) now() time.Time {
+	return c.t
+}
+
+func TestProgress(t *testing.T) {
+	setFlags(t, "progress-interval", "200ms")
+	var out bytes.Buffer
+	clock := &fakeClock{time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	p := &progress{out: &out, now: clock.now}
+	blank := "\r" + strings.Repeat(" ", len("1 files searched, 2 matches, b.txt")) + "\r"
+	steps := []struct {
+		after time.Duration
+		do    func()
+		want  string
+	}{
+		// the first update is drawn straight away
+		{0, func() { p.startFile("a.txt") }, "\r0 files searched, 0 matches, a.txt\r"},
+		{100 * time.Millisecond, func() { p.endFile(2) }, ""},
+		{50 * time.Millisecond, func() { p.startFile("b.txt") }, ""},
+		// the interval has passed since the line was drawn
+		{50 * time.Millisecond, func() { p.startFile("b.txt") }, "\r1 files searched, 2 matches, b.txt\r"},
+		// a shorter line has to cover what's left of the longer one
+		{200 * time.Millisecond, func() { p.startFile("c") }, "\r1 files searched, 2 matches, c    \r"},
+		// printing output erases the line, and it's drawn again at once
+		{0, func() { p.output() }, "\r" + strings.Repeat(" ", len("1 files searched, 2 matches, c")) + "\r"},
+		{0, func() { p.output() }, ""},
+		{0, func() { p.endFile(0) }, "\r2 files searched, 2 matches, c\r"},
+		{0, func() { p.startFile("b.txt") }, ""},
+		{300 * time.Millisecond, func() { p.startFile("b.txt") }, "\r2 files searched, 2 matches, b.txt\r"},
+		{0, func() { p.done() }, blank},
+	}
+	for i, step := range steps {
+		clock.t = clock.t.Add(step.after)
+		out.Reset()
+		step.do()
+		if got := out.String(); got != step.want {
+			t.Errorf("step %d wrote %q, want %q", i, got, step.want)
+		}
+	}
+
+	// without a terminal, there's no progress to update
+	var none *progress
+	none.startFile("a.txt")
+	none.endFile(1)
+	none.output()
+	none.done()
+}
+
+func TestJSONProgress(t *testing.T) {
+	setFlags(t, "progress-interval", "1s")
+	var out bytes.Buffer
+	clock := &fakeClock{time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	p := &progress{out: &out, now: clock.now, json: true}
+	steps := []struct {
+		after time.Duration
+		do    func()
+		want  string
+	}{
+		{0, func() { p.startFile("a.txt") }, `{"searched":0,"matched":0,"current":"a.txt"}` + "\n"},
+		{0, func() { p.endFile(2) }, ""},
+		// output doesn't get in the way of JSON
+		{0, func() { p.output() }, ""},
+		{time.Second, func() { p.startFile("b.txt") }, `{"searched":1,"matched":2,"current":"b.txt"}` + "\n"},
+		{0, func() { p.endFile(1) }, ""},
+		// the final progress is written however recent the last was
+		{0, func() { p.done() }, `{"searched":2,"matched":3,"current":""}` + "\n"},
+	}
+	for i, step := range steps {
+		clock.t = clock.t.Add(step.after)
+		out.Reset()
+		step.do()
+		if got := out.String(); got != step.want {
+			t.Errorf("step %d wrote %q, want %q", i, got, step.want)
+		}
+	}
+}
+
+func TestProgressJSONRun(t *testing.T) {
+	dir := t.TempDir()
+	files := make(map[string]string)
+	for i := 0; i < 20; i++ {
+		files[fmt.Sprintf("%02d.txt", i)] = strings.Repeat("foo\n", i%3)
+	}
+	writeFiles(t, dir, files)
+	_, stderr, _ := runGrep(t, dir, "", "-progress-json", "-progress-interval", "0", "-r", "-c", "foo", ".")
+	type report struct {
+		Searched int    `json:"searched"`
+		Matched  int    `json:"matched"`
+		Current  string `json:"current"`
+	}
+	var reports []report
+	for _, line := range strings.Split(strings.TrimSuffix(stderr, "\n"), "\n") {
+		var r report
+		if err := json.Unmarshal([]byte(line), &r); err != nil {
+			t.Fatalf("-progress-json wrote %q: %v", line, err)
+		}
+		reports = append(reports, r)
+	}
+	// one as each file is started and finished, and one at the end
+	if len(reports) != 41 {
+		t.Fatalf("-progress-json wrote %d objects, want 41", len(reports))
+	}
+	want := []report{
+		{0, 0, "00.txt"}, {1, 0, "00.txt"},
+		{1, 0, "01.txt"}, {2, 1, "01.txt"},
+		{2, 1, "02.txt"}, {3, 3, "02.txt"},
+	}
+	if !reflect.DeepEqual(reports[:6], want) {
+		t.Errorf("-progress-json began with %v, want %v", reports[:6], want)
+	}
+	if last := reports[40]; !reflect.DeepEqual(last, report{20, 19, ""}) {
+		t.Errorf("-progress-json ended with %v, want %v", last, report{20, 19, ""})
+	}
+}
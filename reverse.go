@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"io"
+)
+
+// reverseBlockSize is how much of the input a reverseReader reads at once.
+const reverseBlockSize = 64 * 1024
+
+var reverse = flag.Bool("reverse", false, "Search each input from its last line to its first, printing matches most recent first (stdin is read completely first)")
+
+// addedNewline is the offset, in what the reverseReader for the input being
+// searched returns, of the newline it added to the end of the input's last
+// line, or -1 if it hasn't added one, so that scanFile can leave it out of
+// the bytes it counts.  Like remaining, it is only used by the goroutine
+// doing the search.
+var addedNewline int64 = -1
+
+// A reverseReader reads the lines of the input between start and end in
+// reverse order, last line first, reading it backwards a block at a time.
+// Every line it returns ends in a newline, even if the input's last line
+// didn't.
+type reverseReader struct {
+	r       io.ReaderAt
+	start   int64  // where the input begins
+	pos     int64  // where pending begins
+	pending []byte // the input from pos up to the first line already returned
+	line    []byte // what is left of the line being returned
+}
+
+func newReverseReader(r io.ReaderAt, start, end int64) *reverseReader {
+	if end < start {
+		end = start
+	}
+	addedNewline = -1
+	return &reverseReader{r: r, start: start, pos: end}
+}
+
+func (r *reverseReader) Read(p []byte) (int, error) {
+	if len(r.line) == 0 {
+		if err := r.nextLine(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.line)
+	r.line = r.line[n:]
+	return n, nil
+}
+
+// nextLine takes the last line of pending as the line to return, reading
+// blocks from further back until there's a whole line, or failing with
+// io.EOF once every line has been returned.
+func (r *reverseReader) nextLine() error {
+	for {
+		// the newline ending the last line isn't the one starting it
+		search := r.pending
+		if len(search) > 0 && search[len(search)-1] == '\n' {
+			search = search[:len(search)-1]
+		}
+		i := bytes.LastIndexByte(search, '\n')
+		if i >= 0 || (r.pos == r.start && len(r.pending) > 0) {
+			r.line = r.pending[i+1:]
+			r.pending = r.pending[:i+1]
+			if r.line[len(r.line)-1] != '\n' {
+				// only the input's last line can lack one, and it's
+				// the first line returned
+				addedNewline = int64(len(r.line))
+				r.line = append(r.line[:len(r.line):len(r.line)], '\n')
+			}
+			return nil
+		}
+		if r.pos == r.start {
+			return io.EOF
+		}
+		if err := r.readBlock(); err != nil {
+			return err
+		}
+	}
+}
+
+// readBlock adds the block of input just before pos to the start of pending.
+func (r *reverseReader) readBlock() error {
+	size := int64(reverseBlockSize)
+	if r.pos-r.start < size {
+		size = r.pos - r.start
+	}
+	block := make([]byte, size, size+int64(len(r.pending)))
+	n, err := r.r.ReadAt(block, r.pos-size)
+	if err != nil && !(err == io.EOF && int64(n) == size) {
+		return err
+	}
+	r.pos -= size
+	r.pending = append(block, r.pending...)
+	return nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestReverseReader(t *testing.T) {
+	var long, longReversed strings.Builder
+	for i := 0; i < 20000; i++ {
+		long.WriteString(fmt.Sprintf("line %d\n", i))
+		longReversed.WriteString(fmt.Sprintf("line %d\n", 19999-i))
+	}
+	tests := []struct {
+		input string
+		start int64
+		want  string
+		added int64 // where the reader added a newline, or -1
+	}{
+		{"", 0, "", -1},
+		{"a\n", 0, "a\n", -1},
+		{"a", 0, "a\n", 1},
+		{"a\nb\nc\n", 0, "c\nb\na\n", -1},
+		{"a\nbb\nccc", 0, "ccc\nbb\na\n", 3},
+		{"\n\n", 0, "\n\n", -1},
+		{"a\n\nb\n", 0, "b\n\na\n", -1},
+		// skipped bytes are left out, even part of a line
+		{"a\nb\nc\n", 2, "c\nb\n", -1},
+		{"abc\nd\n", 1, "d\nbc\n", -1},
+		{"a\nb\n", 4, "", -1},
+		// longer than a block, so lines span blocks
+		{long.String(), 0, longReversed.String(), -1},
+	}
+	for _, test := range tests {
+		for _, oneByte := range []bool{false, true} {
+			var r io.Reader = newReverseReader(strings.NewReader(test.input), test.start, int64(len(test.input)))
+			if oneByte {
+				r = iotest.OneByteReader(r)
+			}
+			got, err := ioutil.ReadAll(r)
+			if err != nil || string(got) != test.want || addedNewline != test.added {
+				t.Errorf("reversing %.20q from %d gave %.20q, %v and a newline added at %d, want %.20q and one at %d", test.input, test.start, got, err, addedNewline, test.want, test.added)
+			}
+		}
+	}
+}
+
+func TestReverse(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"log": "foo1\nbar\nfoo2\nfoo3",
+	})
+	tests := []struct {
+		args  []string
+		stdin string
+		want  string
+	}{
+		{[]string{"-reverse", "foo", "log"}, "", "log: foo3\nlog: foo2\nlog: foo1\n"},
+		{[]string{"-reverse", "-limit", "2", "foo", "log"}, "", "log: foo3\nlog: foo2\n"},
+		{[]string{"-reverse", "-v", "foo", "log"}, "", "log: bar\n"},
+		{[]string{"-reverse", "foo"}, "foo1\nbar\nfoo2\n", "stdin: foo2\nstdin: foo1\n"},
+		// the newline added to the last line isn't counted
+		{[]string{"-bytes", "foo", "log"}, "", "log: 14\n"},
+		{[]string{"-reverse", "-bytes", "foo", "log"}, "", "log: 14\n"},
+		{[]string{"-reverse", "-bytes", "bar"}, "foo\nbar", "3\n"},
+		{[]string{"-reverse", "-bytes", "foo"}, "foo\nbar", "4\n"},
+	}
+	for _, test := range tests {
+		if stdout, _, _ := runGrep(t, dir, test.stdin, test.args...); stdout != test.want {
+			t.Errorf("grep %s printed %q, want %q", strings.Join(test.args, " "), stdout, test.want)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"strconv"
+)
+
+// defaultStringsLength is the minimum run length -strings-mode uses when
+// it is given without one, the same as the strings command's default.
+const defaultStringsLength = 4
+
+// A stringsFlag is the value of the strings-mode flag: the minimum length
+// of the printable runs searched, or 0 if lines are searched as usual.
+// Like a bool flag it can be given without a value.
+type stringsFlag int
+
+func (f *stringsFlag) String() string {
+	return strconv.Itoa(int(*f))
+}
+
+func (f *stringsFlag) Set(value string) error {
+	switch value {
+	case "true":
+		*f = defaultStringsLength
+		return nil
+	case "false":
+		*f = 0
+		return nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 1 {
+		return errors.New("the minimum length must be a positive number")
+	}
+	*f = stringsFlag(n)
+	return nil
+}
+
+func (f *stringsFlag) IsBoolFlag() bool {
+	return true
+}
+
+var stringsMode stringsFlag
+
+func init() {
+	flag.Var(&stringsMode, "strings-mode", "Like strings | grep, search each run of at least N printable ASCII characters instead of each line, so text in binary files can be found (give the length as -strings-mode=N, e.g. -strings-mode=8, since -strings-mode 8 takes 8 as the pattern; a plain -strings-mode uses 4)")
+}
+
+// scanStrings returns a split function for a bufio.Scanner that, like the
+// strings command, splits its input into the runs of at least min
+// printable ASCII characters in it, skipping everything else.
+func scanStrings(min int) bufio.SplitFunc {
+	return func(data []byte, atEOF bool) (advance int, token []byte, err error) {
+		start := 0
+		for {
+			for start < len(data) && !printableASCII(data[start]) {
+				start++
+			}
+			end := start
+			for end < len(data) && printableASCII(data[end]) {
+				end++
+			}
+			if end == len(data) && !atEOF {
+				// the run may carry on, so skip what's before it
+				// and request more data
+				return start, nil, nil
+			}
+			if end-start >= min {
+				return end, data[start:end], nil
+			}
+			if end == len(data) {
+				return end, nil, nil
+			}
+			start = end
+		}
+	}
+}
+
+// printableASCII reports whether b is a printable ASCII character or a
+// tab, the bytes the strings command looks for.
+func printableASCII(b byte) bool {
+	return b == '\t' || (' ' <= b && b <= '~')
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestScanStrings(t *testing.T) {
+	long := strings.Repeat("a", 10000)
+	tests := []struct {
+		input string
+		min   int
+		want  []string
+	}{
+		{"", 4, nil},
+		{"hello", 4, []string{"hello"}},
+		{"\x00\x01hello\x02ab\x03world!\x00\ttab\x00", 4, []string{"hello", "world!", "\ttab"}},
+		{"\x00\x01hello\x02ab\x03world!\x00\ttab\x00", 2, []string{"hello", "ab", "world!", "\ttab"}},
+		{"\x00\x01hello\x02ab\x03world!\x00\ttab\x00", 6, []string{"world!"}},
+		{"abc\ndef\n", 3, []string{"abc", "def"}},
+		// only ASCII is printable
+		{"\xffabc\xe9d\xc3\xa9fg", 3, []string{"abc"}},
+		{"\x00\x00" + long + "\x00", 4, []string{long}},
+		{strings.Repeat("\x00", 10000) + "tail", 4, []string{"tail"}},
+	}
+	for _, test := range tests {
+		for _, oneByte := range []bool{false, true} {
+			var r io.Reader = strings.NewReader(test.input)
+			if oneByte {
+				r = iotest.OneByteReader(r)
+			}
+			scanner := bufio.NewScanner(r)
+			scanner.Split(scanStrings(test.min))
+			var got []string
+			for scanner.Scan() {
+				got = append(got, scanner.Text())
+			}
+			if err := scanner.Err(); err != nil || !reflect.DeepEqual(got, test.want) {
+				t.Errorf("scanStrings(%d) split %.20q into %.20q (%v), want %.20q", test.min, test.input, got, err, test.want)
+			}
+		}
+	}
+}
+
+func TestStringsModeOffsets(t *testing.T) {
+	// "world" is 15 bytes in
+	input := "\x00\x00junk\x00\x00\x00hello world\x00more"
+	tests := []struct {
+		min     string
+		pattern string
+		want    []string
+	}{
+		{"4", "world", []string{"15"}},
+		{"4", "junk", []string{"2"}},
+		{"5", "junk", nil},
+		{"4", "more", []string{"21"}},
+	}
+	for _, test := range tests {
+		for _, oneByte := range []bool{false, true} {
+			setFlags(t, "strings-mode", test.min, "first-match-offset", "true")
+			var r io.Reader = strings.NewReader(input)
+			if oneByte {
+				r = iotest.OneByteReader(r)
+			}
+			if _, got, _ := scanReader(r, test.pattern, binaryAuto); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("-strings-mode %s found %q at %q, want %q", test.min, test.pattern, got, test.want)
+			}
+		}
+	}
+}
+
+func TestStringsFlag(t *testing.T) {
+	tests := []struct {
+		value string
+		want  stringsFlag
+		ok    bool
+	}{
+		{"true", defaultStringsLength, true},
+		{"false", 0, true},
+		{"7", 7, true},
+		{"0", 0, false},
+		{"-1", 0, false},
+		{"x", 0, false},
+	}
+	for _, test := range tests {
+		var f stringsFlag
+		err := f.Set(test.value)
+		if (err == nil) != test.ok || (test.ok && f != test.want) {
+			t.Errorf("setting -strings-mode to %q gave %d and %v, want %d", test.value, f, err, test.want)
+		}
+	}
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"fw.bin": "\x7fELF\x00\x01\x02version 1.2.3\x00\x00\xff\xfeok\x00",
+	})
+	runs := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"version", "fw.bin"}, "fw.bin: Binary File Matches\n"},
+		{[]string{"-strings-mode", "version", "fw.bin"}, "fw.bin: version 1.2.3\n"},
+		{[]string{"-strings-mode", "ok", "fw.bin"}, ""},
+		{[]string{"-strings-mode=2", "ok", "fw.bin"}, "fw.bin: ok\n"},
+	}
+	for _, test := range runs {
+		if stdout, _, _ := runGrep(t, dir, "", test.args...); stdout != test.want {
+			t.Errorf("grep %s printed %q, want %q", strings.Join(test.args, " "), stdout, test.want)
+		}
+	}
+}